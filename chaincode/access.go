@@ -0,0 +1,198 @@
+package chaincode
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	roleAttribute = "role"
+	adminRole     = "admin"
+	librarianRole = "librarian"
+	patronRole    = "patron"
+
+	// patronIDAttribute optionally names the patron a certificate belongs to.
+	// When it is absent the enrollment ID is used.
+	patronIDAttribute     = "patronID"
+	enrollmentIDAttribute = "hf.EnrollmentID"
+)
+
+var (
+	staffRoles = []string{adminRole, librarianRole}
+	anyRole    = []string{adminRole, librarianRole, patronRole}
+)
+
+// transactionRoles lists the roles allowed to call each transaction.
+// Transactions missing from it are refused.
+var transactionRoles = map[string][]string{
+	"InitLedger":                        {adminRole},
+	"CreateBook":                        staffRoles,
+	"ReadBook":                          anyRole,
+	"UpdateBook":                        staffRoles,
+	"PatchBook":                         staffRoles,
+	"DeleteBook":                        staffRoles,
+	"WithdrawBook":                      staffRoles,
+	"BookExists":                        anyRole,
+	"BorrowBook":                        anyRole,
+	"ReturnBook":                        staffRoles,
+	"RenewBook":                         anyRole,
+	"GetAllBooks":                       anyRole,
+	"GetAllBooksWithPagination":         anyRole,
+	"GetBookHistory":                    staffRoles,
+	"GetTitleHistory":                   staffRoles,
+	"AddCopy":                           staffRoles,
+	"ReadTitle":                         anyRole,
+	"GetAllTitles":                      anyRole,
+	"GetTitleCopies":                    anyRole,
+	"GetBooksByISBN":                    anyRole,
+	"GetBooksByAuthor":                  anyRole,
+	"GetBooksByPublisher":               anyRole,
+	"QueryBooks":                        anyRole,
+	"QueryBooksWithPagination":          anyRole,
+	"PlaceHold":                         anyRole,
+	"CancelHold":                        anyRole,
+	"ExpireHold":                        anyRole,
+	"GetHoldQueue":                      staffRoles,
+	"RegisterPatron":                    staffRoles,
+	"UpdatePatron":                      staffRoles,
+	"SuspendPatron":                     staffRoles,
+	"ReinstatePatron":                   staffRoles,
+	"ReadPatron":                        anyRole,
+	"ReportLost":                        staffRoles,
+	"PayFine":                           staffRoles,
+	"WaiveFine":                         staffRoles,
+	"GetPatronBalance":                  anyRole,
+	"QueryBooksByPattern":               anyRole,
+	"QueryBooksByPatternWithPagination": anyRole,
+	"GetAllRecords":                     staffRoles,
+	"GetLoanHistoryByBook":              staffRoles,
+	"GetLoanHistoryByBorrower":          anyRole,
+	"GetOverdueLoans":                   staffRoles,
+	"GetLoansDueBefore":                 staffRoles,
+	"MigrateLegacyKeys":                 {adminRole},
+}
+
+// GetBeforeTransaction makes the contract check transactionRoles before
+// every transaction.
+func (s *SmartContract) GetBeforeTransaction() interface{} {
+	return authorize
+}
+
+// authorize checks the caller's role against the transaction being invoked.
+func authorize(ctx contractapi.TransactionContextInterface) error {
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	// Strip the contract namespace, e.g. "SmartContract:CreateBook".
+	function = function[strings.LastIndex(function, ":")+1:]
+
+	roles, ok := transactionRoles[function]
+	if !ok {
+		return forbidden("no roles are declared for function %s", function)
+	}
+	if err := assertRole(ctx, roles...); err != nil {
+		return withPrefix(function, err)
+	}
+	return nil
+}
+
+// assertRole checks that the role attribute of the caller's certificate is
+// one of roles.
+func assertRole(ctx contractapi.TransactionContextInterface, roles ...string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to read caller attributes: %v", err)
+	}
+	if !found {
+		return forbidden("caller is not authorized as %s: certificate has no %s attribute", strings.Join(roles, " or "), roleAttribute)
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return nil
+		}
+	}
+	return forbidden("caller is not authorized as %s: role is %s", strings.Join(roles, " or "), role)
+}
+
+// enrollmentID returns the caller's enrollment ID, taken from the
+// hf.EnrollmentID attribute or else the certificate's common name.
+func enrollmentID(ctx contractapi.TransactionContextInterface) (string, error) {
+	identity := ctx.GetClientIdentity()
+	id, found, err := identity.GetAttributeValue(enrollmentIDAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller attributes: %v", err)
+	}
+	if found && id != "" {
+		return id, nil
+	}
+	cert, err := identity.GetX509Certificate()
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller certificate: %v", err)
+	}
+	if cert == nil || cert.Subject.CommonName == "" {
+		return "", forbidden("caller certificate has no enrollment ID")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// callerPatronID returns the patron the caller acts as. A registered patron
+// can only be acted as by members of the organization recorded on it, so a
+// certificate with the same name issued by another organization's CA is
+// refused.
+func callerPatronID(ctx contractapi.TransactionContextInterface) (string, error) {
+	id, found, err := ctx.GetClientIdentity().GetAttributeValue(patronIDAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller attributes: %v", err)
+	}
+	if !found || id == "" {
+		id, err = enrollmentID(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	patron, err := getPatron(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if patron == nil || patron.MSPID == "" {
+		return id, nil
+	}
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+	if mspID != patron.MSPID {
+		return "", forbidden("caller is not the patron %s: the patron belongs to %s, caller to %s", id, patron.MSPID, mspID)
+	}
+	return id, nil
+}
+
+// callerIdentity returns the caller as "<MSP ID>/<enrollment ID>".
+func callerIdentity(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+	id, err := enrollmentID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + id, nil
+}
+
+// resolvePatron returns the patron a transaction acts for. Callers act for
+// themselves unless they are librarians or admins.
+func resolvePatron(ctx contractapi.TransactionContextInterface, patron string) (string, error) {
+	self, err := callerPatronID(ctx)
+	if err != nil {
+		return "", err
+	}
+	if patron == "" || patron == self {
+		return self, nil
+	}
+	if err := assertRole(ctx, staffRoles...); err != nil {
+		return "", withPrefix("cannot act for "+patron, err)
+	}
+	return patron, nil
+}
@@ -0,0 +1,151 @@
+package chaincode
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-contract-api-go/metadata"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// NewChaincode returns the library chaincode serving contract. The contract
+// metadata is generated from the transactions of SmartContract and returned
+// by the org.hyperledger.fabric:GetMetadata transaction.
+//
+// The chaincode also accepts the calls of clients written for the shim-based
+// chaincode this contract replaced, such as borrowBook, addBook and GetBook,
+// borrowBook and BorrowBook calls that still name the borrower, and an Init
+// without a function, which loads the sample books like InitLedger did.
+func NewChaincode(contract *SmartContract) (shim.Chaincode, error) {
+	if contract.Info.Title == "" {
+		contract.Info = metadata.InfoMetadata{
+			Title:       "library",
+			Description: "Catalogue, circulation, holds and fines of a library",
+		}
+	}
+	cc, err := contractapi.NewChaincode(contract)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chaincode: %v", err)
+	}
+	return &legacyChaincode{contract: contract, cc: cc}, nil
+}
+
+// legacyCall is a call to a transaction, which a legacyTransaction adapts
+// from the form the shim-based chaincode accepted.
+type legacyCall struct {
+	args      []string
+	transient map[string][]byte
+}
+
+// legacyTransaction maps a function of the shim-based chaincode to the
+// transaction that replaced it.
+type legacyTransaction struct {
+	name string
+	// adapt, when set, rewrites the arguments of a call that does not pass
+	// what the transaction expects.
+	adapt func(stub shim.ChaincodeStubInterface, call *legacyCall) error
+}
+
+// legacyTransactions lists the functions of the shim-based chaincode whose
+// name or arguments changed. The others, such as QueryBooksByPattern, are
+// called as they are; transactions added since take every argument.
+var legacyTransactions = map[string]legacyTransaction{
+	"BorrowBook": {name: "BorrowBook", adapt: withTransientBorrower},
+	"addBook":    {name: "CreateBook"},
+	"borrowBook": {name: "BorrowBook", adapt: withTransientBorrower},
+	"returnBook": {name: "ReturnBook"},
+	"GetBook":    {name: "ReadBook"},
+}
+
+type legacyChaincode struct {
+	contract *SmartContract
+	cc       *contractapi.ContractChaincode
+}
+
+// Init loads the sample books when it is called without a function, as the
+// shim-based chaincode did, and otherwise runs the transaction named.
+func (c *legacyChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	if function, _ := stub.GetFunctionAndParameters(); function != "" {
+		return c.Invoke(stub)
+	}
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(stub)
+	if err := c.contract.InitLedger(ctx); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (c *legacyChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	function, args := stub.GetFunctionAndParameters()
+	legacy, ok := legacyTransactions[function]
+	if !ok {
+		return c.cc.Invoke(stub)
+	}
+
+	call := &legacyCall{args: args}
+	if legacy.adapt != nil {
+		if err := legacy.adapt(stub, call); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return c.cc.Invoke(&legacyStub{ChaincodeStubInterface: stub, function: legacy.name, call: call})
+}
+
+// withTransientBorrower moves the borrower of a borrowBook or BorrowBook call
+// with the arguments (id, borrower), the form used before the borrower was
+// taken from the caller's identity, to the "patron" transient field.
+// BorrowBook then only lets staff borrow for someone else.
+func withTransientBorrower(stub shim.ChaincodeStubInterface, call *legacyCall) error {
+	if len(call.args) != 2 {
+		return nil
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to get transient data: %v", err)
+	}
+	borrower := call.args[1]
+	if patron := string(transient[transientPatronKey]); patron != "" && patron != borrower {
+		return invalid("the borrower %s does not match the patron %s in the transient data", borrower, patron)
+	}
+
+	call.args = call.args[:1]
+	call.transient = make(map[string][]byte, len(transient)+1)
+	for key, value := range transient {
+		call.transient[key] = value
+	}
+	call.transient[transientPatronKey] = []byte(borrower)
+	return nil
+}
+
+// legacyStub presents a legacy call to the contract as a call to the
+// transaction that replaced it.
+type legacyStub struct {
+	shim.ChaincodeStubInterface
+	function string
+	call     *legacyCall
+}
+
+func (s *legacyStub) GetFunctionAndParameters() (string, []string) {
+	return s.function, s.call.args
+}
+
+func (s *legacyStub) GetStringArgs() []string {
+	return append([]string{s.function}, s.call.args...)
+}
+
+func (s *legacyStub) GetArgs() [][]byte {
+	args := [][]byte{[]byte(s.function)}
+	for _, arg := range s.call.args {
+		args = append(args, []byte(arg))
+	}
+	return args
+}
+
+func (s *legacyStub) GetTransient() (map[string][]byte, error) {
+	if s.call.transient != nil {
+		return s.call.transient, nil
+	}
+	return s.ChaincodeStubInterface.GetTransient()
+}
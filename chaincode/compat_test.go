@@ -0,0 +1,131 @@
+package chaincode_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/chaincode"
+)
+
+func TestLegacyCalls(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	cc, err := chaincode.NewChaincode(l.SmartContract)
+	require.NoError(t, err)
+	invoke := func(transient map[string][]byte, args ...string) ([]byte, error) {
+		response := l.stub.Invoke(cc, transient, args...)
+		if response.Status >= shim.ERRORTHRESHOLD {
+			var coded chaincode.Error
+			if json.Unmarshal([]byte(response.Message), &coded) == nil {
+				return nil, plain(&coded)
+			}
+			return nil, errorString(response.Message)
+		}
+		return response.Payload, nil
+	}
+
+	require.EqualValues(t, shim.OK, l.stub.Init(cc).Status)
+	payload, err := invoke(nil, "GetBook", "B1")
+	require.NoError(t, err)
+	var book chaincode.Book
+	require.NoError(t, json.Unmarshal(payload, &book))
+	require.Equal(t, "Book1", book.Name)
+
+	_, err = invoke(nil, "addBook", "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")
+	require.NoError(t, err)
+	require.Equal(t, "Book6", l.readBook("B6").Name)
+	payload, err = invoke(nil, "QueryBooksByPattern", "p2")
+	require.NoError(t, err)
+	var books []*chaincode.Book
+	require.NoError(t, json.Unmarshal(payload, &books))
+	require.Len(t, books, 3)
+
+	// Transactions added since the shim-based chaincode are not adapted, so
+	// they must be called with the version the change is based on.
+	_, err = invoke(nil, "PatchBook", "B6", `{"description":"Patched"}`)
+	require.EqualError(t, err, "Incorrect number of params. Expected 3, received 2")
+	_, err = invoke(nil, "PatchBook", "B6", `{"description":"Patched"}`, "1")
+	require.NoError(t, err)
+	require.Equal(t, "Patched", l.readBook("B6").Description)
+	_, err = invoke(nil, "PatchBook", "B6", `{"description":"Stale"}`, "1")
+	require.EqualError(t, err, "version conflict on book B6: expected version 1, current version is 2")
+	requireCode(t, err, chaincode.CodeVersionConflict)
+	response := l.stub.Invoke(cc, nil, "GetBook", "B9")
+	require.Equal(t, `{"code":"not_found","message":"the book B9 does not exist"}`, response.Message)
+
+	l.registerPatron("alice", 1)
+	l.registerPatron("bob", 1)
+	l.asPatron("alice")
+	_, err = invoke(nil, "addBook", "B7", "Book7", "Author7", "p2", "978-7-111-00007-5", "")
+	require.EqualError(t, err, "CreateBook: caller is not authorized as admin or librarian: role is patron")
+	requireCode(t, err, chaincode.CodeForbidden)
+	_, err = invoke(nil, "borrowBook", "B6")
+	require.NoError(t, err)
+	require.False(t, l.readBook("B6").Available)
+	_, err = invoke(nil, "returnBook", "B6")
+	require.EqualError(t, err, "ReturnBook: caller is not authorized as admin or librarian: role is patron")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	_, err = invoke(nil, "returnBook", "B6")
+	require.NoError(t, err)
+
+	// BorrowBook used to name the borrower, which only staff may now do.
+	l.asPatron("bob")
+	_, err = invoke(nil, "BorrowBook", "B2", "alice")
+	require.EqualError(t, err, "cannot act for alice: caller is not authorized as admin or librarian: role is patron")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	_, err = invoke(forPatron("bob"), "BorrowBook", "B2", "alice")
+	require.EqualError(t, err, "the borrower alice does not match the patron bob in the transient data")
+	_, err = invoke(nil, "BorrowBook", "B2", "alice")
+	require.NoError(t, err)
+	records, err := l.GetLoanHistoryByBorrower(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	require.Equal(t, "B2", records[0].BookID)
+
+	details := map[string][]byte{"patronDetails": []byte(`{"ID":"alice","name":"Alice","category":"adult","maxLoans":2}`)}
+	_, err = invoke(details, "UpdatePatron")
+	requireCode(t, err, chaincode.CodeVersionConflict)
+	patron, err := l.ReadPatron(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	details["patronDetails"] = []byte(fmt.Sprintf(`{"ID":"alice","name":"Alice","category":"adult","maxLoans":2,"version":%d}`, patron.Version))
+	_, err = invoke(details, "UpdatePatron")
+	require.NoError(t, err)
+	l.asPatron("bob")
+	_, err = invoke(nil, "borrowBook", "B3", "alice")
+	require.EqualError(t, err, "cannot act for alice: caller is not authorized as admin or librarian: role is patron")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	_, err = invoke(nil, "borrowBook", "B3", "alice")
+	require.NoError(t, err)
+	records, err = l.GetLoanHistoryByBorrower(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	require.Len(t, records, 3)
+	_, err = invoke(nil, "WithdrawBook", "B6", "damaged")
+	require.Error(t, err)
+	_, err = invoke(nil, "WithdrawBook", "B6", "damaged", fmt.Sprint(l.readBook("B6").Version))
+	require.NoError(t, err)
+	require.True(t, l.readBook("B6").Withdrawn)
+
+	payload, err = invoke(nil, "org.hyperledger.fabric:GetMetadata")
+	require.NoError(t, err)
+	var metadata struct {
+		Contracts map[string]struct {
+			Info struct {
+				Title string `json:"title"`
+			} `json:"info"`
+			Transactions []struct {
+				Name string `json:"name"`
+			} `json:"transactions"`
+		} `json:"contracts"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &metadata))
+	contract := metadata.Contracts["SmartContract"]
+	require.Equal(t, "library", contract.Info.Title)
+	require.Contains(t, contract.Transactions, struct {
+		Name string `json:"name"`
+	}{"BorrowBook"})
+}
+
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
@@ -0,0 +1,87 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrorCode classifies the rejection of a transaction.
+type ErrorCode string
+
+// Codes of the errors the contract returns. Errors without a code, such as
+// failures to read or write the ledger, are internal errors.
+const (
+	// CodeInvalid means the arguments or transient data are malformed.
+	CodeInvalid ErrorCode = "invalid"
+	// CodeNotFound means a book, title, patron or hold does not exist.
+	CodeNotFound ErrorCode = "not_found"
+	// CodeForbidden means the caller may not run the transaction, or not for
+	// the patron it names.
+	CodeForbidden ErrorCode = "forbidden"
+	// CodeConflict means the transaction conflicts with the state of the
+	// library, such as borrowing a book that is on loan.
+	CodeConflict ErrorCode = "conflict"
+	// CodeVersionConflict means an update was based on a version of a book or
+	// patron that is no longer current. Clients should read it again and
+	// retry.
+	CodeVersionConflict ErrorCode = "version_conflict"
+)
+
+// Error is a rejection of a transaction. The contract API passes only the
+// text of an error to clients, so Error returns it as JSON:
+//
+//	{"code":"not_found","message":"the book B9 does not exist"}
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// err is the error the rejection was made from, if any.
+	err error
+}
+
+func (e *Error) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
+	}
+	return string(bytes)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+func newError(code ErrorCode, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalid(format string, args ...interface{}) error {
+	return newError(CodeInvalid, format, args...)
+}
+
+func notFound(format string, args ...interface{}) error {
+	return newError(CodeNotFound, format, args...)
+}
+
+func forbidden(format string, args ...interface{}) error {
+	return newError(CodeForbidden, format, args...)
+}
+
+func conflict(format string, args ...interface{}) error {
+	return newError(CodeConflict, format, args...)
+}
+
+// withCode gives err a code, keeping its message.
+func withCode(code ErrorCode, err error) error {
+	return &Error{Code: code, Message: err.Error(), err: err}
+}
+
+// withPrefix prefixes the message of err, keeping its code, so that a
+// wrapped rejection is not encoded twice.
+func withPrefix(prefix string, err error) error {
+	var coded *Error
+	if errors.As(err, &coded) {
+		return &Error{Code: coded.Code, Message: prefix + ": " + coded.Message, err: coded.err}
+	}
+	return fmt.Errorf("%s: %v", prefix, err)
+}
@@ -0,0 +1,284 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/clock"
+	"github.com/yunlong-le/library/events"
+)
+
+// Types of fine entries.
+const (
+	FineCharge  = "charge"
+	FinePayment = "payment"
+	FineWaiver  = "waiver"
+
+	fineObjectType = "fine"
+)
+
+// FineEntry is a charge, payment or waiver on a patron's account. Amounts are
+// in cents. Entries are kept in the private data collection.
+type FineEntry struct {
+	EntryID string `json:"entryID"`
+	Patron  string `json:"patron"`
+	Type    string `json:"type"`
+	Amount  int64  `json:"amount"`
+	BookID  string `json:"bookID,omitempty" metadata:",optional"`
+	Reason  string `json:"reason,omitempty" metadata:",optional"`
+	Time    int64  `json:"time"`
+}
+
+// PatronBalance is what a patron owes and the entries it is made of.
+type PatronBalance struct {
+	Patron  string       `json:"patron"`
+	Balance int64        `json:"balance"`
+	Entries []*FineEntry `json:"entries"`
+}
+
+// PayFine records a payment of amount cents, taken at the desk, by the patron
+// named in the "patron" transient field. A payment cannot exceed the
+// outstanding balance. Only staff record payments, so patrons cannot clear
+// their own balance.
+func (s *SmartContract) PayFine(ctx contractapi.TransactionContextInterface, amount int64) error {
+	patron, err := requiredTransientPatron(ctx)
+	if err != nil {
+		return err
+	}
+	entry, err := s.settleFine(ctx, patron, FinePayment, amount, "")
+	if err != nil {
+		return err
+	}
+	return events.Emit(ctx.GetStub(), &events.FinePaid{EntryID: entry.EntryID, Amount: entry.Amount, Time: entry.Time})
+}
+
+// WaiveFine forgives amount cents of the fines of the patron named in the
+// "patron" transient field.
+func (s *SmartContract) WaiveFine(ctx contractapi.TransactionContextInterface, amount int64, reason string) error {
+	patron, err := requiredTransientPatron(ctx)
+	if err != nil {
+		return err
+	}
+	entry, err := s.settleFine(ctx, patron, FineWaiver, amount, reason)
+	if err != nil {
+		return err
+	}
+	return events.Emit(ctx.GetStub(), &events.FineWaived{EntryID: entry.EntryID, Amount: entry.Amount, Reason: entry.Reason, Time: entry.Time})
+}
+
+// GetPatronBalance returns the balance of a patron, or of the caller when
+// patron is empty. Patrons may only read their own balance.
+func (s *SmartContract) GetPatronBalance(ctx contractapi.TransactionContextInterface, patron string) (*PatronBalance, error) {
+	patron, err := resolvePatron(ctx, patron)
+	if err != nil {
+		return nil, err
+	}
+	return patronBalance(ctx, patron)
+}
+
+// ReportLost ends the loan of a book that the borrower lost. The borrower is
+// charged the overdue fine plus the lost item fee, the holds on the book are
+// cancelled and the book can no longer be borrowed.
+func (s *SmartContract) ReportLost(ctx contractapi.TransactionContextInterface, id string) error {
+	book, err := s.getBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if book.Borrower == "" {
+		return conflict("the book %s is not borrowed", id)
+	}
+
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	fine := s.overdueFine(book.DueTime, now.Unix()) + s.lostItemFee()
+	if err := chargeFine(ctx, book.Borrower, id, fine, "lost", now.Unix()); err != nil {
+		return err
+	}
+	if err := s.updateOpenRecord(ctx, book, func(record *Record) {
+		record.ReturnTime = now.Unix()
+		record.Fine = fine
+	}); err != nil {
+		return err
+	}
+	if err := s.adjustActiveLoans(ctx, book.Borrower, -1); err != nil {
+		return err
+	}
+
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, hold := range holds {
+		if err := s.deleteHold(ctx, hold); err != nil {
+			return err
+		}
+	}
+
+	loanID := book.LoanRef
+	book.Borrower = ""
+	book.LoanRef = ""
+	book.Available = false
+	book.DueTime = 0
+	book.Renewals = 0
+	book.HeldFor = ""
+	book.HoldExpiry = 0
+	book.Lost = true
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), &events.BookLost{BookID: id, LoanID: loanID, ReportTime: now.Unix(), Fine: fine})
+}
+
+// overdueFine is the fine for a book returned at returnTime. Every started
+// day counts in full, up to the fine cap.
+func (s *SmartContract) overdueFine(dueTime int64, returnTime int64) int64 {
+	if dueTime == 0 || returnTime <= dueTime {
+		return 0
+	}
+	const day = 24 * 60 * 60
+	days := (returnTime - dueTime + day - 1) / day
+	fine := days * s.fineDailyRate()
+	if fine > s.fineCap() {
+		return s.fineCap()
+	}
+	return fine
+}
+
+// checkFineBalance refuses to lend to a patron who owes more than the fine
+// block threshold.
+func (s *SmartContract) checkFineBalance(ctx contractapi.TransactionContextInterface, patron string) error {
+	balance, err := patronBalance(ctx, patron)
+	if err != nil {
+		return err
+	}
+	if balance.Balance > s.fineBlockThreshold() {
+		return conflict("%s owes %d, which exceeds the borrowing limit of %d", patron, balance.Balance, s.fineBlockThreshold())
+	}
+	return nil
+}
+
+// settleFine records a payment or waiver, which cannot exceed the
+// outstanding balance.
+func (s *SmartContract) settleFine(ctx contractapi.TransactionContextInterface, patron string, entryType string, amount int64, reason string) (*FineEntry, error) {
+	if amount <= 0 {
+		return nil, invalid("amount must be positive, got %d", amount)
+	}
+	balance, err := patronBalance(ctx, patron)
+	if err != nil {
+		return nil, err
+	}
+	if amount > balance.Balance {
+		return nil, conflict("%s of %d exceeds the outstanding balance of %d for %s", entryType, amount, balance.Balance, patron)
+	}
+
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return nil, err
+	}
+	entry := &FineEntry{
+		EntryID: ctx.GetStub().GetTxID(),
+		Patron:  patron,
+		Type:    entryType,
+		Amount:  amount,
+		Reason:  reason,
+		Time:    now.Unix(),
+	}
+	if err := putFineEntry(ctx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// chargeFine charges a patron for a book. Nothing is recorded for a zero
+// amount.
+func chargeFine(ctx contractapi.TransactionContextInterface, patron string, bookID string, amount int64, reason string, now int64) error {
+	if amount == 0 {
+		return nil
+	}
+	entry := &FineEntry{
+		EntryID: ctx.GetStub().GetTxID(),
+		Patron:  patron,
+		Type:    FineCharge,
+		Amount:  amount,
+		BookID:  bookID,
+		Reason:  reason,
+		Time:    now,
+	}
+	return putFineEntry(ctx, entry)
+}
+
+// patronBalance adds up the fine entries of a patron.
+func patronBalance(ctx contractapi.TransactionContextInterface, patron string) (*PatronBalance, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(patronCollection, fineObjectType, []string{patron})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	balance := &PatronBalance{Patron: patron, Entries: []*FineEntry{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry FineEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Type == FineCharge {
+			balance.Balance += entry.Amount
+		} else {
+			balance.Balance -= entry.Amount
+		}
+		balance.Entries = append(balance.Entries, &entry)
+	}
+
+	return balance, nil
+}
+
+func putFineEntry(ctx contractapi.TransactionContextInterface, entry *FineEntry) error {
+	key, err := ctx.GetStub().CreateCompositeKey(fineObjectType, []string{entry.Patron, entry.EntryID})
+	if err != nil {
+		return err
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutPrivateData(patronCollection, key, entryJSON)
+}
+
+func (s *SmartContract) fineDailyRate() int64 {
+	if s.FineDailyRate == nil {
+		return DefaultFineDailyRate
+	}
+	return *s.FineDailyRate
+}
+
+func (s *SmartContract) fineCap() int64 {
+	if s.FineCap == nil {
+		return DefaultFineCap
+	}
+	return *s.FineCap
+}
+
+func (s *SmartContract) fineBlockThreshold() int64 {
+	if s.FineBlockThreshold == nil {
+		return DefaultFineBlockThreshold
+	}
+	return *s.FineBlockThreshold
+}
+
+func (s *SmartContract) lostItemFee() int64 {
+	if s.LostItemFee == nil {
+		return DefaultLostItemFee
+	}
+	return *s.LostItemFee
+}
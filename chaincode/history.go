@@ -0,0 +1,238 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// BookHistoryEntry is one change of a book, taken from the history of its
+// world state key.
+type BookHistoryEntry struct {
+	TxID string `json:"txID"`
+	// Timestamp is the proposal time of the transaction in Unix seconds.
+	Timestamp int64 `json:"timestamp"`
+	IsDelete  bool  `json:"isDelete"`
+	// Book is the value written by the change, or nil for a delete. It holds
+	// what the item stored at the time and is not joined with its title.
+	Book *Book `json:"book,omitempty" metadata:",optional"`
+	// Changes lists the fields that differ from the previous version. The
+	// first version lists all of its fields.
+	Changes []FieldChange `json:"changes"`
+}
+
+// FieldChange is a field whose value changed. Old and New hold the JSON of
+// the values and are empty when the field is absent.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty" metadata:",optional"`
+	New   string `json:"new,omitempty" metadata:",optional"`
+}
+
+// TitleHistoryEntry is one change of a title, taken from the history of its
+// world state key.
+type TitleHistoryEntry struct {
+	TxID string `json:"txID"`
+	// Timestamp is the proposal time of the transaction in Unix seconds.
+	Timestamp int64 `json:"timestamp"`
+	IsDelete  bool  `json:"isDelete"`
+	// Title is the value written by the change, or nil for a delete.
+	Title *Title `json:"title,omitempty" metadata:",optional"`
+	// Changes lists the fields that differ from the previous version. The
+	// first version lists all of its fields.
+	Changes []FieldChange `json:"changes"`
+}
+
+// GetBookHistory returns every change of a book, newest first, with the
+// fields each change modified. The catalogue details of a book belong to its
+// title, so an edit of them shows here only as a change of titleID, when the
+// book moves to another title, or of version; GetTitleHistory returns what
+// the edit changed.
+func (s *SmartContract) GetBookHistory(ctx contractapi.TransactionContextInterface, id string) ([]*BookHistoryEntry, error) {
+	key, err := bookKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	modifications, err := keyHistory(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []*BookHistoryEntry{}
+	for _, modification := range modifications {
+		entry := &BookHistoryEntry{TxID: modification.txID, Timestamp: modification.timestamp, IsDelete: modification.isDelete}
+		if !modification.isDelete {
+			var book Book
+			err = json.Unmarshal(modification.value, &book)
+			if err != nil {
+				return nil, err
+			}
+			entry.Book = &book
+		}
+		history = append(history, entry)
+	}
+
+	// The history is returned newest first, so each version is compared with
+	// the one after it.
+	for i, entry := range history {
+		var previous *Book
+		if i+1 < len(history) {
+			previous = history[i+1].Book
+		}
+		entry.Changes, err = diffBooks(previous, entry.Book)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// GetTitleHistory returns every change of a title, newest first, with the
+// fields each change modified. Edits of the catalogue details of a book,
+// such as its description, are changes of its title.
+func (s *SmartContract) GetTitleHistory(ctx contractapi.TransactionContextInterface, id string) ([]*TitleHistoryEntry, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(titleObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	modifications, err := keyHistory(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(modifications) == 0 {
+		return nil, notFound("the title %s does not exist", id)
+	}
+
+	history := []*TitleHistoryEntry{}
+	for _, modification := range modifications {
+		entry := &TitleHistoryEntry{TxID: modification.txID, Timestamp: modification.timestamp, IsDelete: modification.isDelete}
+		if !modification.isDelete {
+			var title Title
+			err = json.Unmarshal(modification.value, &title)
+			if err != nil {
+				return nil, err
+			}
+			entry.Title = &title
+		}
+		history = append(history, entry)
+	}
+
+	for i, entry := range history {
+		var previous *Title
+		if i+1 < len(history) {
+			previous = history[i+1].Title
+		}
+		entry.Changes, err = diffTitles(previous, entry.Title)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// keyModification is one change of a world state key.
+type keyModification struct {
+	txID      string
+	timestamp int64
+	isDelete  bool
+	value     []byte
+}
+
+// keyHistory returns the changes of a world state key, newest first.
+func keyHistory(ctx contractapi.TransactionContextInterface, key string) ([]keyModification, error) {
+	resultsIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var modifications []keyModification
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		entry := keyModification{txID: modification.TxId, isDelete: modification.IsDelete, value: modification.Value}
+		if modification.Timestamp != nil {
+			entry.timestamp = modification.Timestamp.Seconds
+		}
+		modifications = append(modifications, entry)
+	}
+	return modifications, nil
+}
+
+// diffBooks returns the fields that differ between two versions of a book,
+// sorted by name. A nil version has no fields.
+func diffBooks(before *Book, after *Book) ([]FieldChange, error) {
+	var oldValue, newValue interface{}
+	if before != nil {
+		oldValue = before
+	}
+	if after != nil {
+		newValue = after
+	}
+	return diffFields(oldValue, newValue)
+}
+
+// diffTitles returns the fields that differ between two versions of a
+// title, sorted by name. A nil version has no fields.
+func diffTitles(before *Title, after *Title) ([]FieldChange, error) {
+	var oldValue, newValue interface{}
+	if before != nil {
+		oldValue = before
+	}
+	if after != nil {
+		newValue = after
+	}
+	return diffFields(oldValue, newValue)
+}
+
+// diffFields returns the JSON fields that differ between two versions of a
+// value, sorted by name. A nil version has no fields.
+func diffFields(before interface{}, after interface{}) ([]FieldChange, error) {
+	oldFields, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		oldValue, newValue := string(oldFields[name]), string(newFields[name])
+		if oldValue != newValue {
+			changes = append(changes, FieldChange{Field: name, Old: oldValue, New: newValue})
+		}
+	}
+	return changes, nil
+}
+
+func jsonFields(value interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if value == nil {
+		return fields, nil
+	}
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(valueJSON, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,310 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/clock"
+	"github.com/yunlong-le/library/events"
+)
+
+// Hold is a patron's place in the reservation queue of a book.
+type Hold struct {
+	HoldID string `json:"holdID"`
+	// Sequence orders the holds of one book, oldest first.
+	Sequence   int64  `json:"sequence"`
+	BookID     string `json:"bookID"`
+	Patron     string `json:"patron"`
+	PlacedTime int64  `json:"placedTime"`
+	// PickupExpiry is set once the book is kept for this patron.
+	PickupExpiry int64 `json:"pickupExpiry"`
+	Version      int64 `json:"version"`
+}
+
+// PlaceHold adds a patron to the end of the hold queue of a book that is
+// currently not available. The patron is read from the "patron" transient
+// field and defaults to the caller.
+func (s *SmartContract) PlaceHold(ctx contractapi.TransactionContextInterface, id string) error {
+	patron, err := transientPatron(ctx)
+	if err != nil {
+		return err
+	}
+	book, err := s.getBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if book.Lost {
+		return conflict("the book %s is lost", id)
+	}
+	if book.Withdrawn {
+		return conflict("the book %s has been withdrawn", id)
+	}
+	if book.Available {
+		return conflict("the book %s is available and does not need a hold", id)
+	}
+	if book.Borrower == patron {
+		return conflict("the book %s is already borrowed by %s", id, patron)
+	}
+
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	var sequence int64
+	for _, hold := range holds {
+		if hold.Patron == patron {
+			return conflict("%s already has a hold on the book %s", patron, id)
+		}
+		sequence = hold.Sequence
+	}
+
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	hold := &Hold{
+		HoldID:     ctx.GetStub().GetTxID(),
+		Sequence:   sequence + 1,
+		BookID:     id,
+		Patron:     patron,
+		PlacedTime: now.Unix(),
+	}
+	if err := s.putHold(ctx, hold); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), &events.HoldPlaced{BookID: id, HoldID: hold.HoldID, Sequence: hold.Sequence, PlacedTime: hold.PlacedTime})
+}
+
+// CancelHold removes a patron, read like in PlaceHold, from the hold queue
+// of a book. When the book was being kept for the patron it passes to the
+// next patron in the queue.
+func (s *SmartContract) CancelHold(ctx contractapi.TransactionContextInterface, id string) error {
+	patron, err := transientPatron(ctx)
+	if err != nil {
+		return err
+	}
+	book, err := s.getBook(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	cancelled, remaining := removeHold(holds, patron)
+	if cancelled == nil {
+		return conflict("%s has no hold on the book %s", patron, id)
+	}
+	if err := s.deleteHold(ctx, cancelled); err != nil {
+		return err
+	}
+
+	if book.HeldFor == patron {
+		if err := s.passToNextPatron(ctx, book, remaining); err != nil {
+			return err
+		}
+		if err := s.putBook(ctx, book); err != nil {
+			return err
+		}
+	}
+
+	return events.Emit(ctx.GetStub(), &events.HoldCancelled{
+		BookID:    id,
+		HoldID:    cancelled.HoldID,
+		Sequence:  cancelled.Sequence,
+		Available: book.Available,
+		Held:      book.HeldFor != "",
+	})
+}
+
+// ExpireHold ends the hold a returned book is kept for once its pickup
+// window has lapsed, so that the book passes to the next patron in its hold
+// queue or goes back on the shelf. Until then the book reads as unavailable,
+// although BorrowBook already lets the next patron take it.
+func (s *SmartContract) ExpireHold(ctx contractapi.TransactionContextInterface, id string) error {
+	book, err := s.getBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if book.HeldFor == "" {
+		return conflict("the book %s is not held for a patron", id)
+	}
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	if now.Unix() <= book.HoldExpiry {
+		return conflict("the book %s is held for a patron until %d", id, book.HoldExpiry)
+	}
+
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	expired, remaining := removeHold(holds, book.HeldFor)
+	if err := s.deleteHold(ctx, expired); err != nil {
+		return err
+	}
+	if err := s.passToNextPatron(ctx, book, remaining); err != nil {
+		return err
+	}
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), &events.HoldExpired{BookID: id, HoldID: expired.HoldID, Sequence: expired.Sequence, Available: book.Available, Held: book.HeldFor != ""})
+}
+
+// GetHoldQueue returns the holds placed on a book, oldest first.
+func (s *SmartContract) GetHoldQueue(ctx contractapi.TransactionContextInterface, id string) ([]*Hold, error) {
+	exists, err := s.BookExists(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, notFound("the book %s does not exist", id)
+	}
+
+	return s.holdQueue(ctx, id)
+}
+
+// checkHolds returns the holds to remove when borrower borrows book, or an
+// error when the book is kept for or queued by someone ahead of borrower.
+// A hold whose pickup window has lapsed no longer blocks anyone.
+func (s *SmartContract) checkHolds(ctx contractapi.TransactionContextInterface, book *Book, borrower string, now int64) ([]*Hold, error) {
+	holds, err := s.holdQueue(ctx, book.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var fulfilled []*Hold
+	for _, hold := range holds {
+		if hold.Patron == borrower {
+			return append(fulfilled, hold), nil
+		}
+		if hold.Patron == book.HeldFor && now > book.HoldExpiry {
+			fulfilled = append(fulfilled, hold)
+			continue
+		}
+		if hold.Patron == book.HeldFor {
+			return nil, conflict("the book %s is held for another patron until %d", book.ID, book.HoldExpiry)
+		}
+		return nil, conflict("the book %s is reserved by another patron", book.ID)
+	}
+	return fulfilled, nil
+}
+
+// removeHold splits the first hold of patron from the rest of holds. The
+// hold is nil when patron has none.
+func removeHold(holds []*Hold, patron string) (*Hold, []*Hold) {
+	var removed *Hold
+	var remaining []*Hold
+	for _, hold := range holds {
+		if hold.Patron == patron && removed == nil {
+			removed = hold
+			continue
+		}
+		remaining = append(remaining, hold)
+	}
+	return removed, remaining
+}
+
+// passToNextPatron ends the hold book is kept for and keeps it for the first
+// patron in holds, the rest of its hold queue, or puts it back on the shelf.
+// The caller stores the book.
+func (s *SmartContract) passToNextPatron(ctx contractapi.TransactionContextInterface, book *Book, holds []*Hold) error {
+	book.HeldFor = ""
+	book.HoldExpiry = 0
+	book.Available = book.Borrower == ""
+	// The deleted hold is still read back until the transaction commits, so
+	// the caller passes the queue without it.
+	return s.holdForNextPatron(ctx, book, holds)
+}
+
+// holdForNextPatron keeps book for the first patron in holds, its hold
+// queue. The caller stores the book.
+func (s *SmartContract) holdForNextPatron(ctx contractapi.TransactionContextInterface, book *Book, holds []*Hold) error {
+	if len(holds) == 0 {
+		return nil
+	}
+
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	next := holds[0]
+	next.PickupExpiry = now.Add(s.pickupWindow()).Unix()
+	if err := s.putHold(ctx, next); err != nil {
+		return err
+	}
+	book.Available = false
+	book.HeldFor = next.Patron
+	book.HoldExpiry = next.PickupExpiry
+	return nil
+}
+
+// holdQueue returns the holds placed on a book, oldest first. Holds are kept
+// in the private data collection.
+func (s *SmartContract) holdQueue(ctx contractapi.TransactionContextInterface, id string) ([]*Hold, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(patronCollection, holdObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	holds := []*Hold{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var hold Hold
+		err = json.Unmarshal(queryResponse.Value, &hold)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, &hold)
+	}
+
+	return holds, nil
+}
+
+// putHold stores a hold as its next version.
+func (s *SmartContract) putHold(ctx contractapi.TransactionContextInterface, hold *Hold) error {
+	hold.Version++
+	key, err := holdKey(ctx, hold)
+	if err != nil {
+		return err
+	}
+	holdJSON, err := json.Marshal(hold)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutPrivateData(patronCollection, key, holdJSON)
+}
+
+func (s *SmartContract) deleteHold(ctx contractapi.TransactionContextInterface, hold *Hold) error {
+	key, err := holdKey(ctx, hold)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().DelPrivateData(patronCollection, key)
+}
+
+func holdKey(ctx contractapi.TransactionContextInterface, hold *Hold) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(holdObjectType, []string{hold.BookID, fmt.Sprintf("%020d", hold.Sequence)})
+}
+
+func (s *SmartContract) pickupWindow() time.Duration {
+	if s.PickupWindow == 0 {
+		return DefaultPickupWindow
+	}
+	return s.PickupWindow
+}
@@ -0,0 +1,123 @@
+package chaincode
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/isbn"
+)
+
+// Secondary indexes over the copies of a title. Each entry is a composite
+// key of the index name, the indexed value and the book ID, so an exact
+// lookup only reads the key range of that value. Entries hold a single zero
+// byte, since Fabric treats writing an empty value as deleting the key.
+const (
+	// titleItemIndex maps a title to the barcodes of its copies.
+	titleItemIndex     = "title~item"
+	isbnBookIndex      = "isbn~id"
+	authorBookIndex    = "author~id"
+	publisherBookIndex = "publisher~id"
+)
+
+// GetBooksByISBN returns the copies with the given ISBN-10 or ISBN-13.
+func (s *SmartContract) GetBooksByISBN(ctx contractapi.TransactionContextInterface, rawISBN string) ([]*Book, error) {
+	canonicalISBN, err := isbn.Normalize(rawISBN)
+	if err != nil {
+		return nil, err
+	}
+	return s.booksByIndex(ctx, isbnBookIndex, canonicalISBN)
+}
+
+// GetBooksByAuthor returns the copies written by author.
+func (s *SmartContract) GetBooksByAuthor(ctx contractapi.TransactionContextInterface, author string) ([]*Book, error) {
+	return s.booksByIndex(ctx, authorBookIndex, author)
+}
+
+// GetBooksByPublisher returns the copies published by publisher.
+func (s *SmartContract) GetBooksByPublisher(ctx contractapi.TransactionContextInterface, publisher string) ([]*Book, error) {
+	return s.booksByIndex(ctx, publisherBookIndex, publisher)
+}
+
+// booksByIndex returns the books whose entry in index has the given value.
+func (s *SmartContract) booksByIndex(ctx contractapi.TransactionContextInterface, index string, value string) ([]*Book, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(index, []string{value})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	books := []*Book{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		book, err := s.ReadBook(ctx, attributes[len(attributes)-1])
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+
+	return books, nil
+}
+
+type bookIndexEntry struct {
+	index string
+	value string
+}
+
+func bookIndexEntries(title *Title) []bookIndexEntry {
+	return []bookIndexEntry{
+		{titleItemIndex, title.ID},
+		{isbnBookIndex, title.ISBN},
+		{authorBookIndex, title.Author},
+		{publisherBookIndex, title.Publisher},
+	}
+}
+
+// putBookIndexes adds the copy id of title to every index.
+func putBookIndexes(ctx contractapi.TransactionContextInterface, title *Title, id string) error {
+	for _, entry := range bookIndexEntries(title) {
+		key, err := ctx.GetStub().CreateCompositeKey(entry.index, []string{entry.value, id})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().PutState(key, []byte{0x00}); err != nil {
+			return fmt.Errorf("failed to put index %s: %v", entry.index, err)
+		}
+	}
+	return nil
+}
+
+// deleteBookIndexes removes the copy id from every index it was added to as
+// a copy of the title with the given ID. Books without a title were never
+// indexed.
+func deleteBookIndexes(ctx contractapi.TransactionContextInterface, titleID string, id string) error {
+	if titleID == "" {
+		return nil
+	}
+	title, err := getTitle(ctx, titleID)
+	if err != nil {
+		return err
+	}
+	if title == nil {
+		title = &Title{ID: titleID}
+	}
+
+	for _, entry := range bookIndexEntries(title) {
+		key, err := ctx.GetStub().CreateCompositeKey(entry.index, []string{entry.value, id})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return fmt.Errorf("failed to delete index %s: %v", entry.index, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/isbn"
+)
+
+// legacyRecordPrefix starts the plain keys under which early versions of the
+// chaincode stored loan records.
+const legacyRecordPrefix = "record-"
+
+// MigratedKeys lists the plain keys rewritten by MigrateLegacyKeys.
+type MigratedKeys struct {
+	Books   []string `json:"books"`
+	Records []string `json:"records"`
+}
+
+// MigrateLegacyKeys moves books and loan records stored under plain keys,
+// such as "B1" and "record-B1", to the composite keys used now. Books
+// without a title are linked to one, and borrowed books without a record
+// get one. The history of a migrated book starts
+// at the migration, since GetBookHistory reads the history of its new key.
+func (s *SmartContract) MigrateLegacyKeys(ctx contractapi.TransactionContextInterface) (*MigratedKeys, error) {
+	// Range queries only return plain keys, never composite ones.
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	migrated := &MigratedKeys{Books: []string{}, Records: []string{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(queryResponse.Key, legacyRecordPrefix) {
+			if err := migrateRecord(ctx, queryResponse.Key, queryResponse.Value); err != nil {
+				return nil, err
+			}
+			migrated.Records = append(migrated.Records, queryResponse.Key)
+		} else {
+			if err := s.migrateBook(ctx, queryResponse.Key, queryResponse.Value); err != nil {
+				return nil, err
+			}
+			migrated.Books = append(migrated.Books, queryResponse.Key)
+		}
+
+		if err := ctx.GetStub().DelState(queryResponse.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateRecord stores a legacy record, which had no loan ID, under its old
+// key as loan ID. Its borrower moves to the private data collection.
+func migrateRecord(ctx contractapi.TransactionContextInterface, key string, value []byte) error {
+	var record Record
+	if err := json.Unmarshal(value, &record); err != nil {
+		return fmt.Errorf("failed to unmarshal record %s: %v", key, err)
+	}
+	record.LoanID = key
+	return putRecord(ctx, &record)
+}
+
+// migrateBook stores a book kept under a plain key under its composite key.
+func (s *SmartContract) migrateBook(ctx contractapi.TransactionContextInterface, key string, value []byte) error {
+	var book Book
+	if err := json.Unmarshal(value, &book); err != nil {
+		return fmt.Errorf("failed to unmarshal book %s: %v", key, err)
+	}
+	// Some books were stored without an ID, which was only their key.
+	if book.ID == "" {
+		book.ID = key
+	}
+	// The oldest books named their borrower. They now refer to their legacy
+	// record, which holds the borrower; a loan whose record was never written
+	// gets one, without the lending time nobody kept.
+	if book.Borrower != "" {
+		book.LoanRef = legacyRecordPrefix + book.ID
+		recordJSON, err := ctx.GetStub().GetState(book.LoanRef)
+		if err != nil {
+			return fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if recordJSON == nil {
+			if err := putRecord(ctx, &Record{LoanID: book.LoanRef, BookID: book.ID, Borrower: book.Borrower}); err != nil {
+				return err
+			}
+		}
+		book.Borrower = ""
+	}
+	if book.TitleID == "" {
+		// An ISBN that cannot be recognised is kept as it is.
+		if canonicalISBN, err := isbn.Normalize(book.ISBN); err == nil {
+			book.ISBN = canonicalISBN
+		}
+		if err := s.linkTitle(ctx, &book); err != nil {
+			return err
+		}
+	}
+	return s.putBook(ctx, &book)
+}
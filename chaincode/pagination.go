@@ -0,0 +1,186 @@
+package chaincode
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// BookPage is one page of books. Paginated queries are only allowed in
+// read-only transactions, so they must be evaluated rather than submitted.
+type BookPage struct {
+	Books []*Book `json:"books"`
+	// Bookmark is passed to the next call to read the following page. It is
+	// empty on the last page.
+	Bookmark string `json:"bookmark"`
+}
+
+// GetAllBooksWithPagination returns a page of at most pageSize books,
+// starting at bookmark.
+func (s *SmartContract) GetAllBooksWithPagination(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*BookPage, error) {
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, err
+	}
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(bookObjectType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	books, err := s.readBooks(ctx, resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+	return &BookPage{Books: books, Bookmark: metadata.Bookmark}, nil
+}
+
+// QueryBooksByPatternWithPagination returns a page of at most pageSize
+// results of a QueryBooksByPattern search. Books are read page by page and
+// filtered until the page is full; the bookmark is the key of the next book
+// to check.
+func (s *SmartContract) QueryBooksByPatternWithPagination(ctx contractapi.TransactionContextInterface, pattern string, pageSize int32, bookmark string) (*BookPage, error) {
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, err
+	}
+
+	patternISBN := normalizedPattern(pattern)
+	page := &BookPage{Books: []*Book{}}
+	for {
+		results, nextBookmark, err := bookStatePage(ctx, pageSize, bookmark)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if len(page.Books) == int(pageSize) {
+				page.Bookmark = result.Key
+				return page, nil
+			}
+			var book Book
+			err = json.Unmarshal(result.Value, &book)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.joinTitle(ctx, &book); err != nil {
+				return nil, err
+			}
+			if !book.Withdrawn && book.matchesPattern(pattern, patternISBN) {
+				page.Books = append(page.Books, &book)
+			}
+		}
+		if nextBookmark == "" {
+			return page, nil
+		}
+		bookmark = nextBookmark
+	}
+}
+
+// QueryBooksWithPagination returns a page of the results of a QueryBooks
+// query. When the peer uses LevelDB, all matching books are sorted in the
+// chaincode and the bookmark is the ID of the first book of the next page.
+func (s *SmartContract) QueryBooksWithPagination(ctx contractapi.TransactionContextInterface, queryJSON string, pageSize int32, bookmark string) (*BookPage, error) {
+	if err := checkPageSize(pageSize); err != nil {
+		return nil, err
+	}
+	query, err := parseBookQuery(queryJSON)
+	if err != nil {
+		return nil, err
+	}
+	queryString, err := query.couchDBQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		if isLevelDBError(err) {
+			return s.scanQueryBooksPage(ctx, query, pageSize, bookmark)
+		}
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	books, err := s.readBooks(ctx, resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+	return &BookPage{Books: books, Bookmark: metadata.Bookmark}, nil
+}
+
+func (s *SmartContract) scanQueryBooksPage(ctx contractapi.TransactionContextInterface, query *bookQuery, pageSize int32, bookmark string) (*BookPage, error) {
+	books, err := s.scanQueryBooks(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if bookmark != "" {
+		start = -1
+		for i, book := range books {
+			if book.ID == bookmark {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			return nil, invalid("invalid bookmark %q", bookmark)
+		}
+	}
+	end := start + int(pageSize)
+	if end >= len(books) {
+		return &BookPage{Books: books[start:]}, nil
+	}
+	return &BookPage{Books: books[start:end], Bookmark: books[end].ID}, nil
+}
+
+// readBooks reads the books returned by a query and joins them with their
+// titles.
+func (s *SmartContract) readBooks(ctx contractapi.TransactionContextInterface, resultsIterator shim.StateQueryIteratorInterface) ([]*Book, error) {
+	books := []*Book{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var book Book
+		err = json.Unmarshal(queryResponse.Value, &book)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.joinTitle(ctx, &book); err != nil {
+			return nil, err
+		}
+		books = append(books, &book)
+	}
+
+	return books, nil
+}
+
+// bookStatePage returns the keys and values of a page of books starting at
+// bookmark, and the bookmark of the next page.
+func bookStatePage(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) ([]*queryresult.KV, string, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(bookObjectType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resultsIterator.Close()
+
+	var results []*queryresult.KV
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		results = append(results, queryResponse)
+	}
+	return results, metadata.Bookmark, nil
+}
+
+func checkPageSize(pageSize int32) error {
+	if pageSize <= 0 {
+		return invalid("page size must be positive, got %d", pageSize)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/events"
+	"github.com/yunlong-le/library/isbn"
+)
+
+// patchableBookFields are the catalogue fields PatchBook may change.
+var patchableBookFields = map[string]bool{
+	"name":        true,
+	"author":      true,
+	"publisher":   true,
+	"isbn":        true,
+	"description": true,
+}
+
+// loanStateFields are the fields only circulation transactions change.
+var loanStateFields = map[string]bool{
+	"available":  true,
+	"borrower":   true,
+	"loanRef":    true,
+	"dueTime":    true,
+	"renewals":   true,
+	"heldFor":    true,
+	"holdExpiry": true,
+	"lost":       true,
+	"overdue":    true,
+}
+
+// PatchBook changes some catalogue fields of a book, given as a JSON object
+// such as {"description":"Second edition"}. Like UpdateBook, a change of
+// name, author, publisher or ISBN moves the book to the matching title, and
+// the description is shared by every copy of the title. The loan state of
+// the book cannot be patched. version is the version of the book the patch
+// is based on.
+func (s *SmartContract) PatchBook(ctx contractapi.TransactionContextInterface, id string, patchJSON string, version int64) error {
+	patch, err := parseBookPatch(patchJSON)
+	if err != nil {
+		return err
+	}
+	book, err := s.storedBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion("book", id, version, book.Version); err != nil {
+		return err
+	}
+	if book.Withdrawn {
+		return conflict("the book %s has been withdrawn", id)
+	}
+	if err := s.joinTitle(ctx, book); err != nil {
+		return err
+	}
+	previousTitleID := book.TitleID
+
+	for field, value := range patch {
+		switch field {
+		case "name":
+			book.Name = value
+		case "author":
+			book.Author = value
+		case "publisher":
+			book.Publisher = value
+		case "isbn":
+			book.ISBN = value
+		case "description":
+			book.Description = value
+		}
+	}
+
+	title := &Title{
+		ID:          titleID(book.Name, book.Author, book.Publisher, book.ISBN),
+		Name:        book.Name,
+		Author:      book.Author,
+		ISBN:        book.ISBN,
+		Publisher:   book.Publisher,
+		Description: book.Description,
+	}
+	// A book moving to an existing title takes its description unless the
+	// patch sets one.
+	if _, ok := patch["description"]; !ok {
+		existing, err := getTitle(ctx, title.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			title.Description = existing.Description
+		}
+	}
+	if err := s.retitle(ctx, book, title); err != nil {
+		return err
+	}
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), bookUpdated(book, previousTitleID))
+}
+
+// parseBookPatch returns the fields of a patch with a normalized ISBN.
+func parseBookPatch(patchJSON string) (map[string]string, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal([]byte(patchJSON), &raw)
+	if err != nil {
+		return nil, invalid("failed to unmarshal patch: %v", err)
+	}
+	if len(raw) == 0 {
+		return nil, invalid("the patch does not change any field")
+	}
+
+	// Check the fields in a fixed order so the error does not depend on map
+	// iteration.
+	fields := make([]string, 0, len(raw))
+	for field := range raw {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	patch := map[string]string{}
+	for _, field := range fields {
+		if loanStateFields[field] {
+			return nil, invalid("%s is loan state and cannot be patched", field)
+		}
+		if !patchableBookFields[field] {
+			return nil, invalid("%s cannot be patched", field)
+		}
+		value, ok := raw[field].(string)
+		if !ok {
+			return nil, invalid("%s must be a string", field)
+		}
+		if field == "isbn" {
+			value, err = isbn.Normalize(value)
+			if err != nil {
+				return nil, withCode(CodeInvalid, err)
+			}
+		}
+		patch[field] = value
+	}
+	return patch, nil
+}
@@ -0,0 +1,264 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/clock"
+	"github.com/yunlong-le/library/events"
+)
+
+const (
+	PatronActive    = "active"
+	PatronSuspended = "suspended"
+	PatronExpired   = "expired"
+
+	patronObjectType = "patron"
+)
+
+// Patron is a registered library user.
+type Patron struct {
+	ID       string `json:"ID"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Status   string `json:"status"`
+	// CardExpiry is when the library card expires. Zero means it never does.
+	CardExpiry int64 `json:"cardExpiry"`
+	// MaxLoans is how many books the patron may have borrowed at once.
+	MaxLoans    int `json:"maxLoans"`
+	ActiveLoans int `json:"activeLoans"`
+	// MSPID is the organization whose members may act as the patron. It
+	// defaults to the organization of the librarian who registered them.
+	// Patrons registered before it was recorded have none and are not
+	// checked.
+	MSPID string `json:"mspID"`
+	// Ref is the opaque reference that patron events carry instead of the
+	// patron ID. It is the ID of the transaction that first stored the
+	// patron.
+	Ref     string `json:"ref"`
+	Version int64  `json:"version"`
+}
+
+// RegisterPatron adds a new active patron. The patron's details are read as
+// JSON from the "patronDetails" transient field, so that they are only
+// written to the private data collection.
+func (s *SmartContract) RegisterPatron(ctx contractapi.TransactionContextInterface) error {
+	details, err := transientPatronDetails(ctx)
+	if err != nil {
+		return err
+	}
+	if details.ID == "" {
+		return invalid("patron ID must not be empty")
+	}
+	if details.MaxLoans <= 0 {
+		return invalid("borrowing limit must be positive, got %d", details.MaxLoans)
+	}
+
+	existing, err := getPatron(ctx, details.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return conflict("the patron %s already exists", details.ID)
+	}
+	mspID := details.MSPID
+	if mspID == "" {
+		mspID, err = ctx.GetClientIdentity().GetMSPID()
+		if err != nil {
+			return fmt.Errorf("failed to read caller MSP ID: %v", err)
+		}
+	}
+
+	patron := &Patron{
+		ID:         details.ID,
+		Name:       details.Name,
+		Category:   details.Category,
+		Status:     PatronActive,
+		CardExpiry: details.CardExpiry,
+		MaxLoans:   details.MaxLoans,
+		MSPID:      mspID,
+	}
+	if err := s.putPatron(ctx, patron); err != nil {
+		return err
+	}
+	return events.Emit(ctx.GetStub(), &events.PatronRegistered{PatronRef: patron.Ref, Category: patron.Category, MaxLoans: patron.MaxLoans, CardExpiry: patron.CardExpiry})
+}
+
+// UpdatePatron changes the details of a patron, read from the "patronDetails"
+// transient field. Their version must be the current version of the patron.
+func (s *SmartContract) UpdatePatron(ctx contractapi.TransactionContextInterface) error {
+	details, err := transientPatronDetails(ctx)
+	if err != nil {
+		return err
+	}
+	if details.MaxLoans <= 0 {
+		return invalid("borrowing limit must be positive, got %d", details.MaxLoans)
+	}
+
+	patron, err := getPatron(ctx, details.ID)
+	if err != nil {
+		return err
+	}
+	if patron == nil {
+		return notFound("the patron %s is not registered", details.ID)
+	}
+	if err := checkVersion("patron", details.ID, details.Version, patron.Version); err != nil {
+		return err
+	}
+	patron.Name = details.Name
+	patron.Category = details.Category
+	patron.CardExpiry = details.CardExpiry
+	patron.MaxLoans = details.MaxLoans
+	if err := s.putPatron(ctx, patron); err != nil {
+		return err
+	}
+	return events.Emit(ctx.GetStub(), &events.PatronUpdated{PatronRef: patron.Ref, Category: patron.Category, MaxLoans: patron.MaxLoans, CardExpiry: patron.CardExpiry})
+}
+
+// SuspendPatron stops the patron named in the "patron" transient field from
+// borrowing.
+func (s *SmartContract) SuspendPatron(ctx contractapi.TransactionContextInterface) error {
+	id, err := requiredTransientPatron(ctx)
+	if err != nil {
+		return err
+	}
+	patron, err := s.setPatronStatus(ctx, id, PatronSuspended)
+	if err != nil {
+		return err
+	}
+	return events.Emit(ctx.GetStub(), &events.PatronSuspended{PatronRef: patron.Ref})
+}
+
+// ReinstatePatron lifts the suspension of the patron named in the "patron"
+// transient field.
+func (s *SmartContract) ReinstatePatron(ctx contractapi.TransactionContextInterface) error {
+	id, err := requiredTransientPatron(ctx)
+	if err != nil {
+		return err
+	}
+	patron, err := s.setPatronStatus(ctx, id, PatronActive)
+	if err != nil {
+		return err
+	}
+	return events.Emit(ctx.GetStub(), &events.PatronReinstated{PatronRef: patron.Ref})
+}
+
+// ReadPatron returns the patron with given id, or the caller when id is
+// empty. Patrons may only read their own record. An active patron whose card
+// has expired is reported as expired.
+func (s *SmartContract) ReadPatron(ctx contractapi.TransactionContextInterface, id string) (*Patron, error) {
+	id, err := resolvePatron(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.readPatron(ctx, id)
+}
+
+func (s *SmartContract) readPatron(ctx contractapi.TransactionContextInterface, id string) (*Patron, error) {
+	patron, err := getPatron(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if patron == nil {
+		return nil, notFound("the patron %s is not registered", id)
+	}
+
+	if patron.Status == PatronActive && patron.CardExpiry != 0 {
+		now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+		if err != nil {
+			return nil, err
+		}
+		if now.Unix() > patron.CardExpiry {
+			patron.Status = PatronExpired
+		}
+	}
+	return patron, nil
+}
+
+// checkPatronCanBorrow returns the patron when they may borrow one more book.
+func (s *SmartContract) checkPatronCanBorrow(ctx contractapi.TransactionContextInterface, id string) (*Patron, error) {
+	patron, err := s.readPatron(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if patron.Status != PatronActive {
+		return nil, conflict("the patron %s is %s", id, patron.Status)
+	}
+	if patron.ActiveLoans >= patron.MaxLoans {
+		return nil, conflict("the patron %s has reached the borrowing limit of %d", id, patron.MaxLoans)
+	}
+	return patron, nil
+}
+
+// adjustActiveLoans changes the loan count of a patron. Borrowers recorded
+// before the registry existed are ignored.
+func (s *SmartContract) adjustActiveLoans(ctx contractapi.TransactionContextInterface, id string, delta int) error {
+	patron, err := getPatron(ctx, id)
+	if err != nil {
+		return err
+	}
+	if patron == nil || patron.ActiveLoans+delta < 0 {
+		return nil
+	}
+	patron.ActiveLoans += delta
+	return s.putPatron(ctx, patron)
+}
+
+func (s *SmartContract) setPatronStatus(ctx contractapi.TransactionContextInterface, id string, status string) (*Patron, error) {
+	patron, err := getPatron(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if patron == nil {
+		return nil, notFound("the patron %s is not registered", id)
+	}
+	patron.Status = status
+	if err := s.putPatron(ctx, patron); err != nil {
+		return nil, err
+	}
+	return patron, nil
+}
+
+// getPatron returns the patron stored in the private data collection, or nil
+// when it does not exist.
+func getPatron(ctx contractapi.TransactionContextInterface, id string) (*Patron, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(patronObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	patronJSON, err := ctx.GetStub().GetPrivateData(patronCollection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data: %v", err)
+	}
+	if patronJSON == nil {
+		return nil, nil
+	}
+
+	var patron Patron
+	err = json.Unmarshal(patronJSON, &patron)
+	if err != nil {
+		return nil, err
+	}
+
+	return &patron, nil
+}
+
+// putPatron stores a patron as its next version. Patrons stored before
+// references were assigned get one.
+func (s *SmartContract) putPatron(ctx contractapi.TransactionContextInterface, patron *Patron) error {
+	if patron.Ref == "" {
+		patron.Ref = ctx.GetStub().GetTxID()
+	}
+	patron.Version++
+	key, err := ctx.GetStub().CreateCompositeKey(patronObjectType, []string{patron.ID})
+	if err != nil {
+		return err
+	}
+	patronJSON, err := json.Marshal(patron)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutPrivateData(patronCollection, key, patronJSON)
+}
@@ -0,0 +1,175 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// patronCollection is the private data collection holding everything that
+// identifies a patron: the registry, hold queues and the borrower of each
+// loan. World state only keeps the opaque loan reference of a book. The
+// collection is defined in collections_config.json.
+const patronCollection = "patronCollection"
+
+// Transient fields carrying personal data, which must not end up in the
+// transaction arguments recorded on the ledger.
+const (
+	// transientPatronKey holds a patron ID.
+	transientPatronKey = "patron"
+	// transientPatronDetailsKey holds a Patron as JSON.
+	transientPatronDetailsKey = "patronDetails"
+
+	loanBorrowerObjectType = "loanBorrower"
+)
+
+// LoanBorrower records who borrowed a book under a loan reference. It is
+// kept in the private data collection.
+type LoanBorrower struct {
+	LoanID   string `json:"loanID"`
+	BookID   string `json:"bookID"`
+	Borrower string `json:"borrower"`
+	// IssuedBy is the identity that lent the book, as "<MSP ID>/<enrollment ID>".
+	IssuedBy string `json:"issuedBy"`
+	Version  int64  `json:"version"`
+}
+
+// transientValue returns a transient field, or nil when it was not passed.
+func transientValue(ctx contractapi.TransactionContextInterface, key string) ([]byte, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	return transient[key], nil
+}
+
+// transientPatron returns the patron a transaction acts for, read from the
+// transient data and defaulting to the caller.
+func transientPatron(ctx contractapi.TransactionContextInterface) (string, error) {
+	patron, err := transientValue(ctx, transientPatronKey)
+	if err != nil {
+		return "", err
+	}
+	return resolvePatron(ctx, string(patron))
+}
+
+// requiredTransientPatron returns the patron ID passed as transient data.
+func requiredTransientPatron(ctx contractapi.TransactionContextInterface) (string, error) {
+	patron, err := transientValue(ctx, transientPatronKey)
+	if err != nil {
+		return "", err
+	}
+	if len(patron) == 0 {
+		return "", invalid("transient data must contain %s", transientPatronKey)
+	}
+	return string(patron), nil
+}
+
+// transientPatronDetails returns the patron passed as transient data.
+func transientPatronDetails(ctx contractapi.TransactionContextInterface) (*Patron, error) {
+	details, err := transientValue(ctx, transientPatronDetailsKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(details) == 0 {
+		return nil, invalid("transient data must contain %s", transientPatronDetailsKey)
+	}
+	var patron Patron
+	if err := json.Unmarshal(details, &patron); err != nil {
+		return nil, invalid("failed to unmarshal %s: %v", transientPatronDetailsKey, err)
+	}
+	return &patron, nil
+}
+
+// getBook reads a book and fills in its borrower and the patron it is held
+// for from the private data collection.
+func (s *SmartContract) getBook(ctx contractapi.TransactionContextInterface, id string) (*Book, error) {
+	book, err := s.ReadBook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if book.LoanRef != "" {
+		loan, err := getLoanBorrower(ctx, book.LoanRef)
+		if err != nil {
+			return nil, err
+		}
+		if loan == nil {
+			return nil, fmt.Errorf("the borrower of loan %s is not found", book.LoanRef)
+		}
+		book.Borrower = loan.Borrower
+	}
+	if book.HoldExpiry != 0 {
+		holds, err := s.holdQueue(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		// The hold a book is kept for is always at the head of the queue.
+		if len(holds) > 0 {
+			book.HeldFor = holds[0].Patron
+		}
+	}
+	return book, nil
+}
+
+// putBook stores the public part of a book in world state as its next
+// version. A book linked to a title is stored as an Item; older books keep
+// their own details.
+func (s *SmartContract) putBook(ctx contractapi.TransactionContextInterface, book *Book) error {
+	book.Version++
+	var state interface{} = book.item()
+	if book.TitleID == "" {
+		public := *book
+		public.Borrower = ""
+		public.HeldFor = ""
+		public.Overdue = false
+		state = &public
+	}
+	key, err := bookKey(ctx, book.ID)
+	if err != nil {
+		return err
+	}
+	bookJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, bookJSON)
+}
+
+func putLoanBorrower(ctx contractapi.TransactionContextInterface, loan *LoanBorrower) error {
+	loan.Version++
+	key, err := ctx.GetStub().CreateCompositeKey(loanBorrowerObjectType, []string{loan.LoanID})
+	if err != nil {
+		return err
+	}
+	loanJSON, err := json.Marshal(loan)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutPrivateData(patronCollection, key, loanJSON)
+}
+
+// getLoanBorrower returns the borrower of a loan, or nil when it is unknown.
+func getLoanBorrower(ctx contractapi.TransactionContextInterface, loanID string) (*LoanBorrower, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(loanBorrowerObjectType, []string{loanID})
+	if err != nil {
+		return nil, err
+	}
+	loanJSON, err := ctx.GetStub().GetPrivateData(patronCollection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data: %v", err)
+	}
+	if loanJSON == nil {
+		return nil, nil
+	}
+
+	var loan LoanBorrower
+	err = json.Unmarshal(loanJSON, &loan)
+	if err != nil {
+		return nil, err
+	}
+
+	return &loan, nil
+}
@@ -0,0 +1,326 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/isbn"
+)
+
+// itemDocType marks item documents, so CouchDB queries can tell them apart
+// from titles and index entries.
+const itemDocType = "item"
+
+// BookQuery is the JSON argument of QueryBooks. Available books of publisher
+// p1 sorted by name are queried with
+//
+//	{"filter":{"publisher":"p1","available":true},"sort":["name"]}
+type BookQuery struct {
+	// Filter maps Book JSON field names to the values they must equal.
+	// Withdrawn books are left out unless the filter sets withdrawn.
+	Filter map[string]interface{} `json:"filter,omitempty"`
+	// Sort lists the fields to sort by. A leading "-" sorts in descending
+	// order; CouchDB requires all fields to be sorted in the same direction.
+	Sort []string `json:"sort,omitempty"`
+}
+
+type queryFieldKind int
+
+const (
+	stringField queryFieldKind = iota
+	boolField
+	numberField
+)
+
+// bookQueryFields are the fields QueryBooks accepts. All of them are stored
+// in item documents, and each sortable field has a CouchDB index in
+// META-INF/statedb/couchdb/indexes.
+var bookQueryFields = map[string]struct {
+	kind     queryFieldKind
+	sortable bool
+}{
+	"ID":         {stringField, true},
+	"titleID":    {stringField, true},
+	"name":       {stringField, true},
+	"author":     {stringField, true},
+	"isbn":       {stringField, true},
+	"publisher":  {stringField, true},
+	"available":  {boolField, false},
+	"dueTime":    {numberField, true},
+	"renewals":   {numberField, false},
+	"holdExpiry": {numberField, false},
+	"lost":       {boolField, false},
+	"withdrawn":  {boolField, false},
+}
+
+// bookQuery is a validated BookQuery. Filter values are strings, bools or
+// int64s.
+type bookQuery struct {
+	filter     map[string]interface{}
+	sort       []string
+	descending bool
+}
+
+// QueryBooks returns the books matching a BookQuery in the requested order.
+// It runs a rich query when the peer uses CouchDB and scans all books when
+// it uses LevelDB. Rich query results are not re-validated at commit time,
+// so they must not be used to decide ledger updates.
+func (s *SmartContract) QueryBooks(ctx contractapi.TransactionContextInterface, queryJSON string) ([]*Book, error) {
+	query, err := parseBookQuery(queryJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	books, err := s.richQueryBooks(ctx, query)
+	if err != nil && isLevelDBError(err) {
+		return s.scanQueryBooks(ctx, query)
+	}
+	return books, err
+}
+
+func parseBookQuery(queryJSON string) (*bookQuery, error) {
+	decoder := json.NewDecoder(strings.NewReader(queryJSON))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	var raw BookQuery
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, invalid("failed to unmarshal query: %v", err)
+	}
+
+	query := &bookQuery{filter: map[string]interface{}{}}
+	for field, value := range raw.Filter {
+		spec, ok := bookQueryFields[field]
+		if !ok {
+			return nil, invalid("unknown query field %q", field)
+		}
+		switch spec.kind {
+		case stringField:
+			str, ok := value.(string)
+			if !ok {
+				return nil, invalid("query field %s must be a string", field)
+			}
+			if field == "isbn" {
+				canonicalISBN, err := isbn.Normalize(str)
+				if err != nil {
+					return nil, withCode(CodeInvalid, err)
+				}
+				str = canonicalISBN
+			}
+			query.filter[field] = str
+		case boolField:
+			b, ok := value.(bool)
+			if !ok {
+				return nil, invalid("query field %s must be a boolean", field)
+			}
+			query.filter[field] = b
+		case numberField:
+			number, ok := value.(json.Number)
+			if !ok {
+				return nil, invalid("query field %s must be an integer", field)
+			}
+			n, err := number.Int64()
+			if err != nil {
+				return nil, invalid("query field %s must be an integer", field)
+			}
+			query.filter[field] = n
+		}
+	}
+
+	for i, field := range raw.Sort {
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		if spec, ok := bookQueryFields[field]; !ok || !spec.sortable {
+			return nil, invalid("cannot sort by %q", field)
+		}
+		if i > 0 && descending != query.descending {
+			return nil, invalid("sort fields must all have the same direction")
+		}
+		query.descending = descending
+		query.sort = append(query.sort, field)
+	}
+	if _, ok := query.filter["withdrawn"]; !ok {
+		query.filter["withdrawn"] = false
+	}
+	return query, nil
+}
+
+// couchDBQuery returns the CouchDB query for q. A false value is matched
+// with $ne true so documents omitting the field match too. CouchDB only
+// sorts by fields that appear in the selector, and the sort starts with
+// docType to use the indexes, which all lead with it.
+func (q *bookQuery) couchDBQuery() (string, error) {
+	selector := map[string]interface{}{"docType": itemDocType}
+	for field, value := range q.filter {
+		if b, ok := value.(bool); ok && !b {
+			selector[field] = map[string]interface{}{"$ne": true}
+		} else {
+			selector[field] = value
+		}
+	}
+
+	direction := "asc"
+	if q.descending {
+		direction = "desc"
+	}
+	query := map[string]interface{}{"selector": selector}
+	if len(q.sort) > 0 {
+		sortBy := []map[string]string{{"docType": direction}}
+		for _, field := range q.sort {
+			if _, ok := selector[field]; !ok {
+				selector[field] = map[string]interface{}{"$gt": nil}
+			}
+			sortBy = append(sortBy, map[string]string{field: direction})
+		}
+		query["sort"] = sortBy
+	}
+
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryJSON), nil
+}
+
+func (s *SmartContract) richQueryBooks(ctx contractapi.TransactionContextInterface, query *bookQuery) ([]*Book, error) {
+	queryString, err := query.couchDBQuery()
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	return s.readBooks(ctx, resultsIterator)
+}
+
+// QueryBooksByPattern returns the books whose name, author, publisher, ISBN,
+// barcode or title ID contains pattern. A pattern that is a valid ISBN in
+// any form also matches the books with that ISBN. Withdrawn books are left
+// out.
+func (s *SmartContract) QueryBooksByPattern(ctx contractapi.TransactionContextInterface, pattern string) ([]*Book, error) {
+	all, err := s.GetAllBooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	patternISBN := normalizedPattern(pattern)
+	books := []*Book{}
+	for _, book := range all {
+		if !book.Withdrawn && book.matchesPattern(pattern, patternISBN) {
+			books = append(books, book)
+		}
+	}
+	return books, nil
+}
+
+// normalizedPattern returns the canonical ISBN a pattern stands for, or ""
+// when it is not an ISBN.
+func normalizedPattern(pattern string) string {
+	patternISBN, err := isbn.Normalize(pattern)
+	if err != nil {
+		return ""
+	}
+	return patternISBN
+}
+
+func (b *Book) matchesPattern(pattern string, patternISBN string) bool {
+	return strings.Contains(b.Name, pattern) ||
+		strings.Contains(b.Author, pattern) ||
+		strings.Contains(b.Publisher, pattern) ||
+		strings.Contains(b.ISBN, pattern) ||
+		(patternISBN != "" && b.ISBN == patternISBN) ||
+		strings.Contains(b.ID, pattern) ||
+		strings.Contains(b.TitleID, pattern)
+}
+
+// isLevelDBError reports whether err is the peer refusing a rich query
+// because its state database is LevelDB.
+func isLevelDBError(err error) bool {
+	return strings.Contains(err.Error(), "not supported for leveldb")
+}
+
+// scanQueryBooks filters and sorts all books in the chaincode. Strings are
+// compared byte by byte, whereas CouchDB uses Unicode collation, so mixed
+// case values may sort differently on the two databases.
+func (s *SmartContract) scanQueryBooks(ctx contractapi.TransactionContextInterface, query *bookQuery) ([]*Book, error) {
+	all, err := s.GetAllBooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	books := []*Book{}
+	for _, book := range all {
+		if query.matches(book) {
+			books = append(books, book)
+		}
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		for _, field := range query.sort {
+			c := compareQueryValues(books[i].queryValue(field), books[j].queryValue(field))
+			if c != 0 {
+				return (c < 0) != query.descending
+			}
+		}
+		return false
+	})
+	return books, nil
+}
+
+func (q *bookQuery) matches(book *Book) bool {
+	for field, value := range q.filter {
+		if book.queryValue(field) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// queryValue returns the value of a field in bookQueryFields.
+func (b *Book) queryValue(field string) interface{} {
+	switch field {
+	case "ID":
+		return b.ID
+	case "titleID":
+		return b.TitleID
+	case "name":
+		return b.Name
+	case "author":
+		return b.Author
+	case "isbn":
+		return b.ISBN
+	case "publisher":
+		return b.Publisher
+	case "available":
+		return b.Available
+	case "dueTime":
+		return b.DueTime
+	case "renewals":
+		return int64(b.Renewals)
+	case "holdExpiry":
+		return b.HoldExpiry
+	case "lost":
+		return b.Lost
+	case "withdrawn":
+		return b.Withdrawn
+	}
+	return nil
+}
+
+func compareQueryValues(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case int64:
+		if a < b.(int64) {
+			return -1
+		}
+		if a > b.(int64) {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,264 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/clock"
+)
+
+const (
+	loanObjectType = "loan"
+	// borrowerLoanIndex indexes the loans of each borrower in the private
+	// data collection.
+	borrowerLoanIndex = "borrower~loan"
+)
+
+// Record is one loan of a book. Records are kept in world state for the
+// whole history of the library; a book has at most one open record, whose
+// ReturnTime is zero.
+type Record struct {
+	LoanID string `json:"loanID"`
+	BookID string `json:"bookID"`
+	// Borrower and IssuedBy are kept in the private data collection. They are
+	// filled in when records are read and never stored in world state.
+	Borrower string `json:"borrower,omitempty" metadata:",optional"`
+	// IssuedBy is the identity that lent the book, as "<MSP ID>/<enrollment ID>".
+	IssuedBy    string `json:"issuedBy,omitempty" metadata:",optional"`
+	LendingTime int64  `json:"lendingTime"`
+	DueTime     int64  `json:"dueTime"`
+	ReturnTime  int64  `json:"returnTime"`
+	Renewals    int    `json:"renewals"`
+	// Fine is the fine in cents charged when the book was returned or lost.
+	Fine int64 `json:"fine"`
+}
+
+// GetAllRecords returns the records of all loans.
+func (s *SmartContract) GetAllRecords(ctx contractapi.TransactionContextInterface) ([]*Record, error) {
+	records, err := queryRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := withBorrowers(ctx, records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetLoanHistoryByBook returns the loans of a book, newest first.
+func (s *SmartContract) GetLoanHistoryByBook(ctx contractapi.TransactionContextInterface, id string) ([]*Record, error) {
+	records, err := queryRecords(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := withBorrowers(ctx, records); err != nil {
+		return nil, err
+	}
+	sortNewestFirst(records)
+	return records, nil
+}
+
+// GetLoanHistoryByBorrower returns the loans of a patron, newest first. An
+// empty patron means the caller; patrons may only read their own loans.
+func (s *SmartContract) GetLoanHistoryByBorrower(ctx contractapi.TransactionContextInterface, patron string) ([]*Record, error) {
+	patron, err := resolvePatron(ctx, patron)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(patronCollection, borrowerLoanIndex, []string{patron})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	records := []*Record{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		record, err := getRecord(ctx, attributes[1], attributes[2])
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return nil, fmt.Errorf("the record %s indexed for %s does not exist", attributes[2], patron)
+		}
+		records = append(records, record)
+	}
+	if err := withBorrowers(ctx, records); err != nil {
+		return nil, err
+	}
+	sortNewestFirst(records)
+	return records, nil
+}
+
+// GetOverdueLoans returns the open loans that are past their due time,
+// earliest due first.
+func (s *SmartContract) GetOverdueLoans(ctx contractapi.TransactionContextInterface) ([]*Record, error) {
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return nil, err
+	}
+	return s.GetLoansDueBefore(ctx, now.Unix())
+}
+
+// GetLoansDueBefore returns the open loans due before timestamp, in Unix
+// seconds, earliest due first.
+func (s *SmartContract) GetLoansDueBefore(ctx contractapi.TransactionContextInterface, timestamp int64) ([]*Record, error) {
+	records, err := queryRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	due := []*Record{}
+	for _, record := range records {
+		// Records migrated from plain keys have no due time.
+		if record.ReturnTime == 0 && record.DueTime != 0 && record.DueTime < timestamp {
+			due = append(due, record)
+		}
+	}
+	if err := withBorrowers(ctx, due); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].DueTime < due[j].DueTime
+	})
+	return due, nil
+}
+
+// updateOpenRecord applies update to the record of the current loan of book
+// and stores it. Loans made before records were kept have none and are left
+// without one.
+func (s *SmartContract) updateOpenRecord(ctx contractapi.TransactionContextInterface, book *Book, update func(record *Record)) error {
+	record, err := getRecord(ctx, book.ID, book.LoanRef)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return nil
+	}
+	update(record)
+	return putRecord(ctx, record)
+}
+
+// putRecord stores the public part of a record in world state. The borrower,
+// when set, is stored in the private data collection with an entry in the
+// borrower's loan index.
+func putRecord(ctx contractapi.TransactionContextInterface, record *Record) error {
+	key, err := recordKey(ctx, record.BookID, record.LoanID)
+	if err != nil {
+		return err
+	}
+	public := *record
+	public.Borrower = ""
+	public.IssuedBy = ""
+	recordJSON, err := json.Marshal(&public)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+		return err
+	}
+
+	if record.Borrower == "" {
+		return nil
+	}
+	loan := &LoanBorrower{
+		LoanID:   record.LoanID,
+		BookID:   record.BookID,
+		Borrower: record.Borrower,
+		IssuedBy: record.IssuedBy,
+	}
+	if err := putLoanBorrower(ctx, loan); err != nil {
+		return err
+	}
+	indexKey, err := ctx.GetStub().CreateCompositeKey(borrowerLoanIndex, []string{record.Borrower, record.BookID, record.LoanID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutPrivateData(patronCollection, indexKey, []byte{0x00})
+}
+
+// getRecord returns the record of a loan, or nil when it does not exist.
+func getRecord(ctx contractapi.TransactionContextInterface, bookID string, loanID string) (*Record, error) {
+	key, err := recordKey(ctx, bookID, loanID)
+	if err != nil {
+		return nil, err
+	}
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if recordJSON == nil {
+		return nil, nil
+	}
+
+	var record Record
+	err = json.Unmarshal(recordJSON, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// queryRecords returns the records whose key starts with attributes: all
+// records, or those of one book.
+func queryRecords(ctx contractapi.TransactionContextInterface, attributes ...string) ([]*Record, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(loanObjectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records := []*Record{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var record Record
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+
+	return records, nil
+}
+
+// withBorrowers fills in the borrowers of records from the private data
+// collection, so it only works on peers of organizations that hold it.
+func withBorrowers(ctx contractapi.TransactionContextInterface, records []*Record) error {
+	for _, record := range records {
+		loan, err := getLoanBorrower(ctx, record.LoanID)
+		if err != nil {
+			return err
+		}
+		if loan != nil {
+			record.Borrower = loan.Borrower
+			record.IssuedBy = loan.IssuedBy
+		}
+	}
+	return nil
+}
+
+func recordKey(ctx contractapi.TransactionContextInterface, bookID string, loanID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(loanObjectType, []string{bookID, loanID})
+}
+
+func sortNewestFirst(records []*Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LendingTime > records[j].LendingTime
+	})
+}
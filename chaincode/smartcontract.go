@@ -3,41 +3,117 @@ package chaincode
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/clock"
+	"github.com/yunlong-le/library/events"
+	"github.com/yunlong-le/library/isbn"
 )
 
+const (
+	// DefaultLoanPeriod is used when SmartContract.LoanPeriod is not set.
+	DefaultLoanPeriod = 14 * 24 * time.Hour
+	// DefaultMaxRenewals is used when SmartContract.MaxRenewals is not set.
+	DefaultMaxRenewals = 2
+	// DefaultPickupWindow is used when SmartContract.PickupWindow is not set.
+	DefaultPickupWindow = 3 * 24 * time.Hour
+	// DefaultFineDailyRate is used when SmartContract.FineDailyRate is not set.
+	DefaultFineDailyRate = 50
+	// DefaultFineCap is used when SmartContract.FineCap is not set.
+	DefaultFineCap = 2000
+	// DefaultFineBlockThreshold is used when SmartContract.FineBlockThreshold
+	// is not set.
+	DefaultFineBlockThreshold = 1000
+	// DefaultLostItemFee is used when SmartContract.LostItemFee is not set.
+	DefaultLostItemFee = 5000
+
+	bookObjectType = "book"
+	holdObjectType = "hold"
+)
+
+// Book is a copy of a title as seen by clients: the Item stored in world
+// state joined with its Title.
 type Book struct {
 	ID          string `json:"ID"`
 	Name        string `json:"name"`
 	Author      string `json:"author"`
 	ISBN        string `json:"isbn"`
 	Description string `json:"description"`
-	Available   bool   `json:"available"`
-	Borrower    string `json:"borrower"`
-	Publisher   string `json:"publisher"`
+	// TitleID links the copy to its title. Books stored before titles existed
+	// have none and keep their own details.
+	TitleID string `json:"titleID,omitempty" metadata:",optional"`
+	// BookKey repeats TitleID under the name older clients read it by. It is
+	// never stored.
+	BookKey   string `json:"bookKey,omitempty" metadata:",optional"`
+	Available bool   `json:"available"`
+	// Borrower is kept in the private data collection under LoanRef. It is
+	// filled in for transactions that need it and never stored in world state.
+	Borrower  string `json:"borrower,omitempty" metadata:",optional"`
+	LoanRef   string `json:"loanRef,omitempty" metadata:",optional"`
+	Publisher string `json:"publisher"`
+	DueTime   int64  `json:"dueTime"`
+	Renewals  int    `json:"renewals"`
+	// HeldFor is the patron a returned book is kept for until HoldExpiry. Like
+	// Borrower it is never stored in world state.
+	HeldFor    string `json:"heldFor,omitempty" metadata:",optional"`
+	HoldExpiry int64  `json:"holdExpiry"`
+	// Lost books were reported lost while on loan. They stay in world state
+	// but can no longer be borrowed or held.
+	Lost bool `json:"lost,omitempty" metadata:",optional"`
+	// Withdrawn books are kept for their history but can no longer be
+	// borrowed and are left out of titles and searches.
+	Withdrawn       bool   `json:"withdrawn,omitempty" metadata:",optional"`
+	WithdrawnReason string `json:"withdrawnReason,omitempty" metadata:",optional"`
+	WithdrawnTime   int64  `json:"withdrawnTime,omitempty" metadata:",optional"`
+	// Overdue is computed from DueTime when the book is read and never stored.
+	Overdue bool `json:"overdue,omitempty" metadata:",optional"`
+	// Version is the version of the stored copy, which UpdateBook expects.
+	Version int64 `json:"version"`
 }
 
 type SmartContract struct {
 	contractapi.Contract
+	// Clock supplies the transaction time. The proposal timestamp is used when nil.
+	Clock clock.Clock
+	// LoanPeriod is how long a book may be borrowed. DefaultLoanPeriod is used when zero.
+	LoanPeriod time.Duration
+	// MaxRenewals is how many times one loan may be renewed; zero allows no
+	// renewals. DefaultMaxRenewals is used when nil.
+	MaxRenewals *int
+	// PickupWindow is how long a returned book is kept for the first patron in
+	// its hold queue. DefaultPickupWindow is used when zero.
+	PickupWindow time.Duration
+	// FineDailyRate is the fine in cents for each started day a book is
+	// overdue; zero charges no overdue fines. DefaultFineDailyRate is used
+	// when nil.
+	FineDailyRate *int64
+	// FineCap is the largest overdue fine in cents for one loan.
+	// DefaultFineCap is used when nil.
+	FineCap *int64
+	// FineBlockThreshold is the balance in cents above which a patron may not
+	// borrow; zero blocks any debt. DefaultFineBlockThreshold is used when nil.
+	FineBlockThreshold *int64
+	// LostItemFee is charged in cents, on top of the overdue fine, for a book
+	// reported lost; zero charges only the overdue fine. DefaultLostItemFee
+	// is used when nil.
+	LostItemFee *int64
 }
 
 func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
 	books := []Book{
-		{ID: "B1", Name: "Book1", Author: "Author1", ISBN: "111-1111111111", Description: "This is book 1", Publisher: "p1", Available: true, Borrower: ""},
-		{ID: "B2", Name: "Book2", Author: "Author2", ISBN: "222-2222222222", Description: "This is book 2", Publisher: "P1", Available: true, Borrower: ""},
-		{ID: "B3", Name: "Book3", Author: "Author3", ISBN: "333-3333333333", Description: "This is book 3", Publisher: "p1", Available: true, Borrower: ""},
-		{ID: "B4", Name: "Book4", Author: "Author4", ISBN: "444-4444444444", Description: "This is book 4", Publisher: "p2", Available: true, Borrower: ""},
-		{ID: "B5", Name: "Book5", Author: "Author5", ISBN: "555-5555555555", Description: "This is book 5", Publisher: "p2", Available: true, Borrower: ""},
+		{ID: "B1", Name: "Book1", Author: "Author1", ISBN: "9787111000013", Description: "This is book 1", Publisher: "p1", Available: true, Borrower: ""},
+		{ID: "B2", Name: "Book2", Author: "Author2", ISBN: "9787111000020", Description: "This is book 2", Publisher: "P1", Available: true, Borrower: ""},
+		{ID: "B3", Name: "Book3", Author: "Author3", ISBN: "9787111000037", Description: "This is book 3", Publisher: "p1", Available: true, Borrower: ""},
+		{ID: "B4", Name: "Book4", Author: "Author4", ISBN: "9787111000044", Description: "This is book 4", Publisher: "p2", Available: true, Borrower: ""},
+		{ID: "B5", Name: "Book5", Author: "Author5", ISBN: "9787111000051", Description: "This is book 5", Publisher: "p2", Available: true, Borrower: ""},
 	}
 
-	for _, book := range books {
-		bookJSON, err := json.Marshal(book)
-		if err != nil {
-			return err
+	for i := range books {
+		err := s.linkTitle(ctx, &books[i])
+		if err == nil {
+			err = s.putBook(ctx, &books[i])
 		}
-
-		err = ctx.GetStub().PutState(book.ID, bookJSON)
 		if err != nil {
 			return fmt.Errorf("failed to put to world state. %v", err)
 		}
@@ -46,41 +122,77 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 	return nil
 }
 
-func (s *SmartContract) CreateBook(ctx contractapi.TransactionContextInterface, id string, bookName string, author string, publisher string, isbn string, description string) error {
+// CreateBook adds a copy with barcode id. It becomes a copy of the existing
+// title with the same details, or of a new title when there is none. The ISBN
+// may be an ISBN-10 or ISBN-13 and is stored as a canonical ISBN-13.
+func (s *SmartContract) CreateBook(ctx contractapi.TransactionContextInterface, id string, bookName string, author string, publisher string, rawISBN string, description string) error {
+	canonicalISBN, err := isbn.Normalize(rawISBN)
+	if err != nil {
+		return withCode(CodeInvalid, err)
+	}
 	exists, err := s.BookExists(ctx, id)
 	if err != nil {
 		return err
 	}
 	if exists {
-		return fmt.Errorf("the book %s already exists", id)
+		return conflict("the book %s already exists", id)
 	}
 
 	// 创建图书对象
 	book := &Book{
+		ID:          id,
 		Name:        bookName,
 		Author:      author,
 		Publisher:   publisher,
-		ISBN:        isbn,
+		ISBN:        canonicalISBN,
 		Borrower:    "",
 		Available:   true,
 		Description: description,
 	}
-	bookJSON, err := json.Marshal(book)
-	if err != nil {
+	if err := s.linkTitle(ctx, book); err != nil {
+		return err
+	}
+	if err := s.putBook(ctx, book); err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(id, bookJSON)
+	return events.Emit(ctx.GetStub(), bookCreated(book))
 }
 
 // ReadBook returns the book stored in the world state with given id.
 func (s *SmartContract) ReadBook(ctx contractapi.TransactionContextInterface, id string) (*Book, error) {
-	bookJSON, err := ctx.GetStub().GetState(id)
+	book, err := s.storedBook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.joinTitle(ctx, book); err != nil {
+		return nil, err
+	}
+
+	if book.DueTime != 0 {
+		now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+		if err != nil {
+			return nil, err
+		}
+		book.Overdue = now.Unix() > book.DueTime
+	}
+
+	return book, nil
+}
+
+// storedBook returns the book as stored in world state, without the details
+// of its title.
+func (s *SmartContract) storedBook(ctx contractapi.TransactionContextInterface, id string) (*Book, error) {
+	key, err := bookKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	bookJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state: %v", err)
 	}
 	if bookJSON == nil {
-		return nil, fmt.Errorf("the book %s does not exist", id)
+		return nil, notFound("the book %s does not exist", id)
 	}
 
 	var book Book
@@ -92,52 +204,107 @@ func (s *SmartContract) ReadBook(ctx contractapi.TransactionContextInterface, id
 	return &book, nil
 }
 
-// UpdateBook updates an existing book in the world state with provided parameters.
-func (s *SmartContract) UpdateBook(ctx contractapi.TransactionContextInterface, id string, bookName string, author string, publisher string, isbn string, description string, borrower string, available bool) error {
-	exists, err := s.BookExists(ctx, id)
+// joinTitle fills in the details of a book from its title.
+func (s *SmartContract) joinTitle(ctx contractapi.TransactionContextInterface, book *Book) error {
+	if book.TitleID == "" {
+		return nil
+	}
+	title, err := getTitle(ctx, book.TitleID)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("the book %s does not exist", id)
+	if title == nil {
+		return fmt.Errorf("the title %s of book %s does not exist", book.TitleID, book.ID)
 	}
+	book.applyTitle(title)
+	return nil
+}
 
-	// overwriting original book with new book
-	// 创建图书对象
-	book := &Book{
-		ID:          id,
+// UpdateBook updates the catalogue details of an existing book in the world
+// state. The details belong to the book's title, so they change for every
+// copy of it; a book whose name, author, publisher or ISBN changes moves to
+// the matching title. The state of a loan or hold on the book is kept, so
+// available cannot change while the book is on loan, kept for a hold or lost.
+// version is the version of the book the update is based on.
+func (s *SmartContract) UpdateBook(ctx contractapi.TransactionContextInterface, id string, bookName string, author string, publisher string, rawISBN string, description string, available bool, version int64) error {
+	canonicalISBN, err := isbn.Normalize(rawISBN)
+	if err != nil {
+		return withCode(CodeInvalid, err)
+	}
+	book, err := s.storedBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion("book", id, version, book.Version); err != nil {
+		return err
+	}
+	if book.Withdrawn {
+		return conflict("the book %s has been withdrawn", id)
+	}
+	if available != book.Available && (book.LoanRef != "" || book.HoldExpiry != 0 || book.Lost) {
+		return conflict("the availability of the book %s cannot change while it is on loan, held or lost", id)
+	}
+
+	title := &Title{
+		ID:          titleID(bookName, author, publisher, canonicalISBN),
 		Name:        bookName,
 		Author:      author,
+		ISBN:        canonicalISBN,
 		Publisher:   publisher,
-		ISBN:        isbn,
-		Borrower:    borrower,
-		Available:   available,
 		Description: description,
 	}
-	bookJSON, err := json.Marshal(book)
-	if err != nil {
+	book.ID = id
+	previousTitleID := book.TitleID
+	if err := s.retitle(ctx, book, title); err != nil {
+		return err
+	}
+	book.Available = available
+	if err := s.putBook(ctx, book); err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(id, bookJSON)
+	return events.Emit(ctx.GetStub(), bookUpdated(book, previousTitleID))
 }
 
-// DeleteBook deletes a given book from the world state.
+// DeleteBook deletes a given book from the world state. Its title is kept.
+// A book that is on loan or has holds cannot be deleted; WithdrawBook retires
+// a book while keeping its history.
 func (s *SmartContract) DeleteBook(ctx contractapi.TransactionContextInterface, id string) error {
-	exists, err := s.BookExists(ctx, id)
+	book, err := s.storedBook(ctx, id)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("the book %s does not exist", id)
+	if book.LoanRef != "" {
+		return conflict("the book %s is on loan and cannot be deleted", id)
+	}
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(holds) > 0 {
+		return conflict("the book %s has holds and cannot be deleted", id)
+	}
+	if err := deleteBookIndexes(ctx, book.TitleID, id); err != nil {
+		return err
+	}
+	key, err := bookKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return err
 	}
 
-	return ctx.GetStub().DelState(id)
+	return events.Emit(ctx.GetStub(), &events.BookDeleted{BookID: id, TitleID: book.TitleID})
 }
 
 // BookExists returns true when book with given ID exists in world state
 func (s *SmartContract) BookExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
-	bookJSON, err := ctx.GetStub().GetState(id)
+	key, err := bookKey(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	bookJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return false, fmt.Errorf("failed to read from world state: %v", err)
 	}
@@ -145,70 +312,211 @@ func (s *SmartContract) BookExists(ctx contractapi.TransactionContextInterface,
 	return bookJSON != nil, nil
 }
 
-// TransferBook updates the owner field of book with given id in world state.
-func (s *SmartContract) BorrowBook(ctx contractapi.TransactionContextInterface, id string, borrower string) error {
-	book, err := s.ReadBook(ctx, id)
+// bookKey returns the world state key of the book with given id.
+func bookKey(ctx contractapi.TransactionContextInterface, id string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(bookObjectType, []string{id})
+}
+
+// BorrowBook lends the book with given id. The borrower is read from the
+// "patron" transient field and defaults to the caller; only librarians may
+// borrow for someone else. Who borrowed the book is recorded in the private
+// data collection, world state only keeps the loan reference.
+func (s *SmartContract) BorrowBook(ctx contractapi.TransactionContextInterface, id string) error {
+	book, err := s.getBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if book.Lost {
+		return conflict("the book %s is lost", id)
+	}
+	if book.Withdrawn {
+		return conflict("the book %s has been withdrawn", id)
+	}
+	if book.Borrower != "" {
+		return conflict("the book %s is already borrowed", id)
+	}
+
+	borrower, err := transientPatron(ctx)
 	if err != nil {
 		return err
 	}
+	issuedBy, err := callerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	patron, err := s.checkPatronCanBorrow(ctx, borrower)
+	if err != nil {
+		return err
+	}
+	if err := s.checkFineBalance(ctx, borrower); err != nil {
+		return err
+	}
+
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	fulfilled, err := s.checkHolds(ctx, book, borrower, now.Unix())
+	if err != nil {
+		return err
+	}
+	for _, hold := range fulfilled {
+		if err := s.deleteHold(ctx, hold); err != nil {
+			return err
+		}
+	}
 
-	book.Borrower = borrower
+	patron.ActiveLoans++
+	if err := s.putPatron(ctx, patron); err != nil {
+		return err
+	}
+	record := &Record{
+		LoanID:      ctx.GetStub().GetTxID(),
+		BookID:      id,
+		Borrower:    borrower,
+		IssuedBy:    issuedBy,
+		LendingTime: now.Unix(),
+		DueTime:     now.Add(s.loanPeriod()).Unix(),
+	}
+	if err := putRecord(ctx, record); err != nil {
+		return err
+	}
 
-	if borrower != "" {
-		book.Available = false
-	} else {
-		book.Available = true
+	book.LoanRef = record.LoanID
+	book.Available = false
+	book.DueTime = record.DueTime
+	book.Renewals = 0
+	book.HoldExpiry = 0
+	if err := s.putBook(ctx, book); err != nil {
+		return err
 	}
 
-	bookJSON, err := json.Marshal(book)
+	return events.Emit(ctx.GetStub(), &events.BookBorrowed{BookID: id, LoanID: record.LoanID, LendingTime: record.LendingTime, DueTime: record.DueTime})
+}
+
+// RenewBook extends the due date of a borrowed book by a new loan period
+// counted from now, unless the renewal limit is reached or another patron
+// is waiting for the book. Patrons may only renew their own loans. An
+// overdue book must be returned, so that its fine is charged, rather than
+// renewed.
+func (s *SmartContract) RenewBook(ctx contractapi.TransactionContextInterface, id string) error {
+	book, err := s.getBook(ctx, id)
 	if err != nil {
 		return err
 	}
+	if book.Borrower == "" {
+		return conflict("the book %s is not borrowed", id)
+	}
+	if _, err := resolvePatron(ctx, book.Borrower); err != nil {
+		return err
+	}
+	if book.Renewals >= s.maxRenewals() {
+		return conflict("the book %s has reached the maximum of %d renewals", id, s.maxRenewals())
+	}
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	if book.DueTime != 0 && now.Unix() > book.DueTime {
+		return conflict("the book %s is overdue and must be returned", id)
+	}
 
-	return ctx.GetStub().PutState(id, bookJSON)
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, hold := range holds {
+		if hold.Patron != book.Borrower {
+			return conflict("the book %s is reserved by another patron", id)
+		}
+	}
+
+	book.DueTime = now.Add(s.loanPeriod()).Unix()
+	book.Renewals++
+	if err := s.updateOpenRecord(ctx, book, func(record *Record) {
+		record.DueTime = book.DueTime
+		record.Renewals = book.Renewals
+	}); err != nil {
+		return err
+	}
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), &events.BookRenewed{BookID: id, LoanID: book.LoanRef, DueTime: book.DueTime, Renewals: book.Renewals})
 }
 
-func (s *SmartContract) returnBook(ctx contractapi.TransactionContextInterface, id string) error {
-	book, err := s.ReadBook(ctx, id)
+// ReturnBook takes back a borrowed book at the desk and charges the borrower
+// for each day it is overdue. When patrons are waiting for it the book is
+// kept for the first of them.
+func (s *SmartContract) ReturnBook(ctx contractapi.TransactionContextInterface, id string) error {
+	book, err := s.getBook(ctx, id)
 	if err != nil {
 		return err
 	}
+	if book.Borrower == "" {
+		return conflict("the book %s is not borrowed", id)
+	}
 
+	if err := s.adjustActiveLoans(ctx, book.Borrower, -1); err != nil {
+		return err
+	}
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	fine := s.overdueFine(book.DueTime, now.Unix())
+	if err := chargeFine(ctx, book.Borrower, id, fine, "overdue", now.Unix()); err != nil {
+		return err
+	}
+	if err := s.updateOpenRecord(ctx, book, func(record *Record) {
+		record.ReturnTime = now.Unix()
+		record.Fine = fine
+	}); err != nil {
+		return err
+	}
+
+	loanID := book.LoanRef
 	book.Borrower = ""
+	book.LoanRef = ""
 	book.Available = true
-
-	bookJSON, err := json.Marshal(book)
+	book.DueTime = 0
+	book.Renewals = 0
+	holds, err := s.holdQueue(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := s.holdForNextPatron(ctx, book, holds); err != nil {
+		return err
+	}
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
 
-	return ctx.GetStub().PutState(id, bookJSON)
+	return events.Emit(ctx.GetStub(), &events.BookReturned{BookID: id, LoanID: loanID, ReturnTime: now.Unix(), Fine: fine, Held: book.HeldFor != ""})
 }
 
 // GetAllBooks returns all books found in world state
 func (s *SmartContract) GetAllBooks(ctx contractapi.TransactionContextInterface) ([]*Book, error) {
-	// range query with empty string for startKey and endKey does an
-	// open-ended query of all books in the chaincode namespace.
-	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(bookObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	var books []*Book
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, err
-		}
+	return s.readBooks(ctx, resultsIterator)
+}
 
-		var book Book
-		err = json.Unmarshal(queryResponse.Value, &book)
-		if err != nil {
-			return nil, err
-		}
-		books = append(books, &book)
+func (s *SmartContract) loanPeriod() time.Duration {
+	if s.LoanPeriod == 0 {
+		return DefaultLoanPeriod
 	}
+	return s.LoanPeriod
+}
 
-	return books, nil
+func (s *SmartContract) maxRenewals() int {
+	if s.MaxRenewals == nil {
+		return DefaultMaxRenewals
+	}
+	return *s.MaxRenewals
 }
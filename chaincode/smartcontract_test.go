@@ -2,183 +2,1160 @@ package chaincode_test
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
-	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
-	"github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
 	"github.com/stretchr/testify/require"
 	"github.com/yunlong-le/library/chaincode"
+	"github.com/yunlong-le/library/clock"
+	"github.com/yunlong-le/library/events"
+	"github.com/yunlong-le/library/memstub"
 )
 
-//go:generate counterfeiter -o mocks/transaction.go -fake-name TransactionContext . transactionContext
-type transactionContext interface {
-	contractapi.TransactionContextInterface
+// library runs the transactions of a contract on an in-memory ledger. A
+// transaction starts with begin, which returns its context, and ends with
+// end, which commits it unless the transaction failed:
+//
+//	err := l.end(l.CreateBook(l.begin(), ...))
+type library struct {
+	*chaincode.SmartContract
+	t    *testing.T
+	stub *memstub.Stub
+	// now is the timestamp of the following transactions.
+	now time.Time
 }
 
-//go:generate counterfeiter -o mocks/chaincodestub.go -fake-name ChaincodeStub . chaincodeStub
-type chaincodeStub interface {
-	shim.ChaincodeStubInterface
+// newLibrary returns an empty ledger, called as a librarian at time 1000.
+func newLibrary(t *testing.T, contract *chaincode.SmartContract) *library {
+	l := &library{SmartContract: contract, t: t, stub: memstub.New("library"), now: time.Unix(1000, 0)}
+	l.stub.Now = func() time.Time { return l.now }
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	return l
 }
 
-//go:generate counterfeiter -o mocks/statequeryiterator.go -fake-name StateQueryIterator . stateQueryIterator
-type stateQueryIterator interface {
-	shim.StateQueryIteratorInterface
+// initLibrary returns a ledger holding the books of InitLedger.
+func initLibrary(t *testing.T, contract *chaincode.SmartContract) *library {
+	l := newLibrary(t, contract)
+	l.as("Org1MSP", "admin", map[string]string{"role": "admin"})
+	require.NoError(t, l.end(l.InitLedger(l.begin())))
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	return l
 }
 
-func TestInitLedger(t *testing.T) {
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+// as makes the following transactions run as the given client.
+func (l *library) as(mspID string, name string, attrs map[string]string) {
+	creator, err := memstub.Creator(mspID, name, attrs)
+	require.NoError(l.t, err)
+	l.stub.Creator = creator
+}
 
-	assetTransfer := chaincode.SmartContract{}
-	err := assetTransfer.InitLedger(transactionContext)
-	require.NoError(t, err)
+func (l *library) asPatron(name string) {
+	l.as("Org1MSP", name, map[string]string{"role": "patron"})
+}
+
+func (l *library) begin() contractapi.TransactionContextInterface {
+	return l.beginWith(nil)
+}
+
+// beginWith starts a transaction with transient data.
+func (l *library) beginWith(transient map[string][]byte) contractapi.TransactionContextInterface {
+	l.stub.BeginWithTransient(transient)
+	return l.context()
+}
+
+func (l *library) context() contractapi.TransactionContextInterface {
+	identity, err := cid.New(l.stub)
+	require.NoError(l.t, err)
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(l.stub)
+	ctx.SetClientIdentity(identity)
+	return ctx
+}
+
+// end commits the current transaction if err is nil and rolls it back
+// otherwise. It returns err, with a coded error shown as its message.
+func (l *library) end(err error) error {
+	if err != nil {
+		l.stub.Rollback()
+	} else {
+		l.stub.Commit()
+	}
+	return plain(err)
+}
+
+// codedError shows a chaincode.Error as its message, so that tests compare
+// messages rather than JSON. The code stays reachable with errors.As.
+type codedError struct {
+	err *chaincode.Error
+}
+
+func (e *codedError) Error() string { return e.err.Message }
+
+func (e *codedError) Unwrap() error { return e.err }
+
+func plain(err error) error {
+	var coded *chaincode.Error
+	if errors.As(err, &coded) {
+		return &codedError{coded}
+	}
+	return err
+}
+
+func requireCode(t *testing.T, err error, code chaincode.ErrorCode) {
+	t.Helper()
+	var coded *chaincode.Error
+	require.ErrorAs(t, err, &coded)
+	require.Equal(t, code, coded.Code, coded.Message)
+}
+
+// registerPatron registers a patron as the current client.
+func (l *library) registerPatron(id string, maxLoans int) {
+	details, err := json.Marshal(&chaincode.Patron{ID: id, Name: id, Category: "adult", MaxLoans: maxLoans})
+	require.NoError(l.t, err)
+	require.NoError(l.t, l.end(l.RegisterPatron(l.beginWith(map[string][]byte{"patronDetails": details}))))
+}
+
+// borrow lends a book to patron, called by patron.
+func (l *library) borrow(patron string, id string) {
+	l.asPatron(patron)
+	require.NoError(l.t, l.end(l.BorrowBook(l.begin(), id)))
+}
+
+func (l *library) readBook(id string) *chaincode.Book {
+	book, err := l.ReadBook(l.begin(), id)
+	require.NoError(l.t, l.end(err))
+	return book
+}
+
+func (l *library) readTitle(id string) *chaincode.TitleAvailability {
+	title, err := l.ReadTitle(l.begin(), id)
+	require.NoError(l.t, l.end(err))
+	return title
+}
+
+func (l *library) holdQueue(id string) []*chaincode.Hold {
+	holds, err := l.GetHoldQueue(l.begin(), id)
+	require.NoError(l.t, l.end(err))
+	return holds
+}
+
+func (l *library) booksByAuthor(author string) []*chaincode.Book {
+	books, err := l.GetBooksByAuthor(l.begin(), author)
+	require.NoError(l.t, l.end(err))
+	return books
+}
+
+// storedBook returns a book as it is stored in the world state.
+func (l *library) storedBook(id string) *chaincode.Book {
+	var book chaincode.Book
+	require.NoError(l.t, json.Unmarshal(l.stub.State(bookKey(id)), &book))
+	return &book
+}
+
+// put writes books to the world state as they are given.
+func (l *library) put(books ...*chaincode.Book) {
+	l.stub.Begin()
+	for _, book := range books {
+		bytes, err := json.Marshal(book)
+		require.NoError(l.t, err)
+		require.NoError(l.t, l.stub.PutState(bookKey(book.ID), bytes))
+	}
+	l.stub.Commit()
+}
+
+// lastEvent decodes the event set by the last transaction.
+func (l *library) lastEvent() events.Event {
+	lastEvent := l.stub.LastEvent()
+	require.NotNil(l.t, lastEvent)
+	event, err := events.Decode(lastEvent.EventName, lastEvent.Payload)
+	require.NoError(l.t, err)
+	return event
+}
+
+func forPatron(patron string) map[string][]byte {
+	return map[string][]byte{"patron": []byte(patron)}
+}
+
+func bookKey(id string) string {
+	key, _ := shim.CreateCompositeKey("book", []string{id})
+	return key
+}
+
+func recordKey(bookID string, loanID string) string {
+	key, _ := shim.CreateCompositeKey("loan", []string{bookID, loanID})
+	return key
+}
+
+func loanKey(loanID string) string {
+	key, _ := shim.CreateCompositeKey("loanBorrower", []string{loanID})
+	return key
+}
+
+func TestInitLedger(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
 
-	chaincodeStub.PutStateReturns(fmt.Errorf("failed inserting key"))
-	err = assetTransfer.InitLedger(transactionContext)
-	require.EqualError(t, err, "failed to put to world state. failed inserting key")
+	books, err := l.GetAllBooks(l.begin())
+	require.NoError(t, l.end(err))
+	require.Len(t, books, 5)
+	require.Equal(t, "B1", books[0].ID)
+	require.Equal(t, "Book1", books[0].Name)
+	require.Equal(t, "9787111000013", books[0].ISBN)
+	require.True(t, books[0].Available)
 }
 
 func TestCreateBook(t *testing.T) {
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+	l := newLibrary(t, &chaincode.SmartContract{})
 
-	assetTransfer := chaincode.SmartContract{}
-	err := assetTransfer.CreateBook(transactionContext, "", "", "", "", "666-", "")
-	require.NoError(t, err)
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")))
+	require.IsType(t, &events.BookCreated{}, l.lastEvent())
+	book := l.readBook("B6")
+	require.Equal(t, "Book6", book.Name)
+	require.Equal(t, "9787111000068", book.ISBN)
+	require.True(t, book.Available)
 
-	chaincodeStub.GetStateReturns([]byte{}, nil)
-	err = assetTransfer.CreateBook(transactionContext, "B6", "Book6", "Author6", "p2", "666-6666666666", "This is book 6")
-	require.EqualError(t, err, "the asset asset6 already exists")
+	err := l.end(l.CreateBook(l.begin(), "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6"))
+	require.EqualError(t, err, "the book B6 already exists")
+	requireCode(t, err, chaincode.CodeConflict)
 
-	chaincodeStub.GetStateReturns(nil, fmt.Errorf("unable to retrieve asset"))
-	err = assetTransfer.CreateBook(transactionContext, "B6", "Book6", "Author6", "p2", "666-6666666666", "This is book 6")
-	require.EqualError(t, err, "failed to read from world state: unable to retrieve asset")
+	// A rejected book leaves nothing behind.
+	keys := l.stub.Keys()
+	err = l.end(l.CreateBook(l.begin(), "B7", "Book7", "Author7", "p2", "978-7-111-00007-4", ""))
+	require.EqualError(t, err, `invalid ISBN "978-7-111-00007-4": check digit is 4, want 5`)
+	requireCode(t, err, chaincode.CodeInvalid)
+	require.Equal(t, keys, l.stub.Keys())
 }
 
 func TestReadBook(t *testing.T) {
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+	l := initLibrary(t, &chaincode.SmartContract{})
+
+	book := l.readBook("B2")
+	require.Equal(t, "Book2", book.Name)
+	require.Equal(t, "Author2", book.Author)
+	require.Equal(t, "P1", book.Publisher)
+	require.Empty(t, book.Borrower)
+
+	_, err := l.ReadBook(l.begin(), "B9")
+	err = l.end(err)
+	require.EqualError(t, err, "the book B9 does not exist")
+	requireCode(t, err, chaincode.CodeNotFound)
+}
+
+func TestUpdateBook(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
+
+	require.NoError(t, l.end(l.UpdateBook(l.begin(), "B1", "Book9", "Author9", "p9", "978-7-111-00009-9", "This is book 9 after update", true, 1)))
+	book := l.readBook("B1")
+	require.Equal(t, "Book9", book.Name)
+	require.Equal(t, "9787111000099", book.ISBN)
+	require.EqualValues(t, 2, book.Version)
+
+	err := l.end(l.UpdateBook(l.begin(), "B9", "Book9", "Author9", "p9", "978-7-111-00009-9", "This is book 9 after update", true, 1))
+	require.EqualError(t, err, "the book B9 does not exist")
+
+	l.registerPatron("alice", 1)
+	l.borrow("alice", "B2")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	err = l.end(l.UpdateBook(l.begin(), "B2", "Book2", "Author2", "P1", "978-7-111-00002-0", "Updated", true, 2))
+	require.EqualError(t, err, "the availability of the book B2 cannot change while it is on loan, held or lost")
+	require.NoError(t, l.end(l.UpdateBook(l.begin(), "B2", "Book2", "Author2", "P1", "978-7-111-00002-0", "Updated", false, 2)))
+	book = l.readBook("B2")
+	require.Equal(t, "Updated", book.Description)
+	require.NotEmpty(t, book.LoanRef)
+}
+
+func TestDeleteBook(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
+
+	require.NoError(t, l.end(l.DeleteBook(l.begin(), "B3")))
+	exists, err := l.BookExists(l.begin(), "B3")
+	require.NoError(t, l.end(err))
+	require.False(t, exists)
+
+	err = l.end(l.DeleteBook(l.begin(), "B3"))
+	require.EqualError(t, err, "the book B3 does not exist")
+}
+
+func TestReturnBook(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
+	l.registerPatron("alice", 1)
+	l.borrow("alice", "B2")
+
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B2")))
+	require.IsType(t, &events.BookReturned{}, l.lastEvent())
+	book := l.readBook("B2")
+	require.True(t, book.Available)
+	require.Empty(t, book.LoanRef)
+
+	err := l.end(l.ReturnBook(l.begin(), "B2"))
+	require.EqualError(t, err, "the book B2 is not borrowed")
+}
+
+func TestGetAllBooks(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	books, err := l.GetAllBooks(l.begin())
+	require.NoError(t, l.end(err))
+	require.Empty(t, books)
+
+	// Titles and indexes live under composite keys, which range queries skip.
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B2", "Book2", "Author2", "p1", "978-7-111-00002-0", "")))
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B1", "Book1", "Author1", "p1", "978-7-111-00001-3", "")))
+	books, err = l.GetAllBooks(l.begin())
+	require.NoError(t, l.end(err))
+	require.Len(t, books, 2)
+	require.Equal(t, "B1", books[0].ID)
+	require.Equal(t, "Book1", books[0].Name)
+	require.Equal(t, "B2", books[1].ID)
+}
 
-	expectedBook := &chaincode.Book{ID: "B1"}
-	bytes, err := json.Marshal(expectedBook)
+func TestBorrowBookDueTime(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour})
+	l.registerPatron("alice", 1)
+	l.borrow("alice", "B1")
+	loanID := l.lastEvent().(*events.BookBorrowed).LoanID
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	patron, err := l.ReadPatron(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	require.Equal(t, 1, patron.ActiveLoans)
+
+	loanBytes, err := l.stub.GetPrivateData("patronCollection", loanKey(loanID))
 	require.NoError(t, err)
+	var loan chaincode.LoanBorrower
+	require.NoError(t, json.Unmarshal(loanBytes, &loan))
+	require.Equal(t, chaincode.LoanBorrower{LoanID: loanID, BookID: "B1", Borrower: "alice", IssuedBy: "Org1MSP/alice", Version: 1}, loan)
+
+	require.NotContains(t, string(l.stub.State(bookKey("B1"))), "alice")
+	book := l.storedBook("B1")
+	require.Equal(t, loanID, book.LoanRef)
+	require.False(t, book.Available)
+	require.EqualValues(t, 1000+3600, book.DueTime)
+	require.False(t, book.Overdue)
+
+	err = l.end(l.BorrowBook(l.beginWith(forPatron("alice")), "B1"))
+	require.EqualError(t, err, "the book B1 is already borrowed")
+}
+
+func TestReadBookOverdue(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour})
+	l.registerPatron("alice", 1)
+	l.borrow("alice", "B1")
+
+	l.Clock = clock.Fixed(time.Unix(4600, 0))
+	require.False(t, l.readBook("B1").Overdue)
+	l.Clock = clock.Fixed(time.Unix(4601, 0))
+	require.True(t, l.readBook("B1").Overdue)
+}
+
+func TestRenewBook(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour, MaxRenewals: count(1)})
+	l.registerPatron("alice", 2)
+	l.registerPatron("bob", 1)
+	l.borrow("alice", "B1")
+	l.borrow("alice", "B2")
+
+	l.now = time.Unix(4000, 0)
+	require.NoError(t, l.end(l.RenewBook(l.begin(), "B1")))
+	book := l.readBook("B1")
+	require.EqualValues(t, 4000+3600, book.DueTime)
+	require.Equal(t, 1, book.Renewals)
+	require.False(t, book.Overdue)
+
+	err := l.end(l.RenewBook(l.begin(), "B1"))
+	require.EqualError(t, err, "the book B1 has reached the maximum of 1 renewals")
+
+	l.asPatron("bob")
+	err = l.end(l.RenewBook(l.begin(), "B2"))
+	require.EqualError(t, err, "cannot act for alice: caller is not authorized as admin or librarian: role is patron")
+	require.NoError(t, l.end(l.PlaceHold(l.begin(), "B2")))
+	l.asPatron("alice")
+	err = l.end(l.RenewBook(l.begin(), "B2"))
+	require.EqualError(t, err, "the book B2 is reserved by another patron")
 
-	chaincodeStub.GetStateReturns(bytes, nil)
-	assetTransfer := chaincode.SmartContract{}
-	asset, err := assetTransfer.ReadBook(transactionContext, "")
+	err = l.end(l.RenewBook(l.begin(), "B3"))
+	require.EqualError(t, err, "the book B3 is not borrowed")
+
+	// An overdue book cannot be renewed, which would waive its fine.
+	l = initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour})
+	l.registerPatron("alice", 1)
+	l.borrow("alice", "B1")
+	l.now = time.Unix(4600+1, 0)
+	err = l.end(l.RenewBook(l.begin(), "B1"))
+	require.EqualError(t, err, "the book B1 is overdue and must be returned")
+	requireCode(t, err, chaincode.CodeConflict)
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	require.EqualValues(t, chaincode.DefaultFineDailyRate, l.lastEvent().(*events.BookReturned).Fine)
+
+	// A library may allow no renewals at all.
+	l = initLibrary(t, &chaincode.SmartContract{MaxRenewals: count(0)})
+	l.registerPatron("alice", 1)
+	l.borrow("alice", "B1")
+	err = l.end(l.RenewBook(l.begin(), "B1"))
+	require.EqualError(t, err, "the book B1 has reached the maximum of 0 renewals")
+}
+
+func TestPlaceHold(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
+	l.registerPatron("alice", 1)
+
+	l.asPatron("bob")
+	err := l.end(l.PlaceHold(l.begin(), "B1"))
+	require.EqualError(t, err, "the book B1 is available and does not need a hold")
+
+	l.borrow("alice", "B1")
+	l.asPatron("carol")
+	require.NoError(t, l.end(l.PlaceHold(l.begin(), "B1")))
+	l.asPatron("bob")
+	require.NoError(t, l.end(l.PlaceHold(l.begin(), "B1")))
+	placed := l.lastEvent().(*events.HoldPlaced)
+	require.Equal(t, &events.HoldPlaced{Header: events.Header{Version: 1}, BookID: "B1", HoldID: placed.HoldID, Sequence: 2, PlacedTime: 1000}, placed)
+	err = l.end(l.PlaceHold(l.begin(), "B1"))
+	require.EqualError(t, err, "bob already has a hold on the book B1")
+
+	key, err := shim.CreateCompositeKey("hold", []string{"B1", "00000000000000000002"})
+	require.NoError(t, err)
+	holdJSON, err := l.stub.GetPrivateData("patronCollection", key)
 	require.NoError(t, err)
-	require.Equal(t, expectedBook, asset)
+	var hold chaincode.Hold
+	require.NoError(t, json.Unmarshal(holdJSON, &hold))
+	require.Equal(t, chaincode.Hold{HoldID: placed.HoldID, Sequence: 2, BookID: "B1", Patron: "bob", PlacedTime: 1000, Version: 1}, hold)
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	holds := l.holdQueue("B1")
+	require.Len(t, holds, 2)
+	require.Equal(t, "carol", holds[0].Patron)
+	require.Equal(t, "bob", holds[1].Patron)
+}
+
+func TestReturnKeepsBookForHold(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{PickupWindow: time.Hour})
+	for _, patron := range []string{"alice", "bob", "carol"} {
+		l.registerPatron(patron, 1)
+	}
+	l.borrow("alice", "B1")
+	for _, patron := range []string{"bob", "carol"} {
+		l.asPatron(patron)
+		require.NoError(t, l.end(l.PlaceHold(l.begin(), "B1")))
+	}
 
-	chaincodeStub.GetStateReturns(nil, fmt.Errorf("unable to retrieve asset"))
-	_, err = assetTransfer.ReadBook(transactionContext, "")
-	require.EqualError(t, err, "failed to read from world state: unable to retrieve asset")
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	holds := l.holdQueue("B1")
+	require.Len(t, holds, 2)
+	require.EqualValues(t, 1000+3600, holds[0].PickupExpiry)
+	require.Zero(t, holds[1].PickupExpiry)
 
-	chaincodeStub.GetStateReturns(nil, nil)
-	asset, err = assetTransfer.ReadBook(transactionContext, "B1")
-	require.EqualError(t, err, "the asset asset1 does not exist")
-	require.Nil(t, asset)
+	// Who the book is kept for stays in the private data collection.
+	book := l.storedBook("B1")
+	require.False(t, book.Available)
+	require.Empty(t, book.LoanRef)
+	require.Empty(t, book.HeldFor)
+	require.EqualValues(t, 1000+3600, book.HoldExpiry)
+
+	l.asPatron("carol")
+	err := l.end(l.BorrowBook(l.begin(), "B1"))
+	require.EqualError(t, err, "the book B1 is held for another patron until 4600")
+
+	// The book passes to carol when bob cancels his hold.
+	l.asPatron("bob")
+	require.NoError(t, l.end(l.CancelHold(l.begin(), "B1")))
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	holds = l.holdQueue("B1")
+	require.Len(t, holds, 1)
+	require.Equal(t, "carol", holds[0].Patron)
+	require.EqualValues(t, 1000+3600, holds[0].PickupExpiry)
+
+	l.borrow("carol", "B1")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.Empty(t, l.holdQueue("B1"))
 }
 
-func TestUpdateBook(t *testing.T) {
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+// The hold a patron cancels is still read back until the transaction
+// commits, so it must not be picked again as the next hold.
+func TestCancelHoldReleasesBook(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{PickupWindow: time.Hour})
+	l.registerPatron("alice", 1)
+	l.registerPatron("bob", 1)
+	l.borrow("alice", "B1")
+	l.asPatron("bob")
+	require.NoError(t, l.end(l.PlaceHold(l.begin(), "B1")))
+	l.asPatron("alice")
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	require.False(t, l.storedBook("B1").Available)
+
+	l.asPatron("bob")
+	require.NoError(t, l.end(l.CancelHold(l.begin(), "B1")))
+	cancelled := l.lastEvent().(*events.HoldCancelled)
+	require.True(t, cancelled.Available)
+	require.False(t, cancelled.Held)
+	book := l.storedBook("B1")
+	require.True(t, book.Available)
+	require.Zero(t, book.HoldExpiry)
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.Empty(t, l.holdQueue("B1"))
+}
+
+func TestExpireHold(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{PickupWindow: time.Hour})
+	for _, patron := range []string{"alice", "bob", "carol"} {
+		l.registerPatron(patron, 1)
+	}
+	l.borrow("alice", "B1")
+	for _, patron := range []string{"bob", "carol"} {
+		l.asPatron(patron)
+		require.NoError(t, l.end(l.PlaceHold(l.begin(), "B1")))
+	}
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	err := l.end(l.ExpireHold(l.begin(), "B1"))
+	require.EqualError(t, err, "the book B1 is held for a patron until 4600")
+	err = l.end(l.ExpireHold(l.begin(), "B2"))
+	require.EqualError(t, err, "the book B2 is not held for a patron")
+
+	// Bob's window lapses and the book is kept for carol.
+	l.now = time.Unix(4600+1, 0)
+	require.NoError(t, l.end(l.ExpireHold(l.begin(), "B1")))
+	expired := l.lastEvent().(*events.HoldExpired)
+	require.False(t, expired.Available)
+	require.True(t, expired.Held)
+	holds := l.holdQueue("B1")
+	require.Len(t, holds, 1)
+	require.Equal(t, "carol", holds[0].Patron)
+	require.EqualValues(t, 4601+3600, l.storedBook("B1").HoldExpiry)
+
+	// Carol's window lapses too and the book goes back on the shelf.
+	l.now = time.Unix(4601+3600+1, 0)
+	require.NoError(t, l.end(l.ExpireHold(l.begin(), "B1")))
+	expired = l.lastEvent().(*events.HoldExpired)
+	require.Equal(t, &events.HoldExpired{Header: events.Header{Version: 1}, BookID: "B1", HoldID: holds[0].HoldID, Sequence: 2, Available: true}, expired)
+	require.Empty(t, l.holdQueue("B1"))
+	book := l.readBook("B1")
+	require.True(t, book.Available)
+	require.Zero(t, book.HoldExpiry)
+	require.Equal(t, 1, l.readTitle(book.TitleID).AvailableCopies)
+}
+
+func TestBorrowBookForAnotherPatron(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
+	l.registerPatron("bob", 2)
+
+	l.asPatron("alice")
+	err := l.end(l.BorrowBook(l.beginWith(forPatron("bob")), "B1"))
+	require.EqualError(t, err, "cannot act for bob: caller is not authorized as admin or librarian: role is patron")
 
-	expectedBook := &chaincode.Book{ID: "asset1"}
-	bytes, err := json.Marshal(expectedBook)
+	l.as("Org1MSP", "user7", map[string]string{"role": "patron", "patronID": "bob"})
+	require.NoError(t, l.end(l.BorrowBook(l.begin(), "B1")))
+
+	l.as("Org2MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.NoError(t, l.end(l.BorrowBook(l.beginWith(forPatron("bob")), "B2")))
+	loanBytes, err := l.stub.GetPrivateData("patronCollection", loanKey(l.storedBook("B2").LoanRef))
 	require.NoError(t, err)
+	var loan chaincode.LoanBorrower
+	require.NoError(t, json.Unmarshal(loanBytes, &loan))
+	require.Equal(t, "bob", loan.Borrower)
+	require.Equal(t, "Org2MSP/librarian1", loan.IssuedBy)
+}
 
-	chaincodeStub.GetStateReturns(bytes, nil)
-	assetTransfer := chaincode.SmartContract{}
-	err = assetTransfer.UpdateBook(transactionContext, "", "", "", "", "", "", "", true)
+func TestTransactionRoles(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	_, err := contractapi.NewChaincode(l.SmartContract)
 	require.NoError(t, err)
+	authorize, ok := l.GetBeforeTransaction().(func(contractapi.TransactionContextInterface) error)
+	require.True(t, ok)
+
+	check := func(function string) error {
+		l.stub.Begin(function)
+		defer l.stub.Rollback()
+		return plain(authorize(l.context()))
+	}
 
-	chaincodeStub.GetStateReturns(nil, nil)
-	err = assetTransfer.UpdateBook(transactionContext, "B1", "Book9", "Author9", "p9", "999-9999999999", "This is book 9 after update", "", false)
-	require.EqualError(t, err, "the asset asset1 does not exist")
+	l.asPatron("alice")
+	require.EqualError(t, check("CreateBook"), "CreateBook: caller is not authorized as admin or librarian: role is patron")
+	require.NoError(t, check("SmartContract:ReadBook"))
+	require.EqualError(t, check("ReturnBook"), "ReturnBook: caller is not authorized as admin or librarian: role is patron")
+	require.EqualError(t, check("PayFine"), "PayFine: caller is not authorized as admin or librarian: role is patron")
 
-	chaincodeStub.GetStateReturns(nil, fmt.Errorf("unable to retrieve asset"))
-	err = assetTransfer.UpdateBook(transactionContext, "B1", "Book9", "Author9", "p9", "999-9999999999", "This is book 9 after update", "", false)
-	require.EqualError(t, err, "failed to read from world state: unable to retrieve asset")
+	l.as("Org1MSP", "mallory", nil)
+	require.EqualError(t, check("ReadBook"), "ReadBook: caller is not authorized as admin or librarian or patron: certificate has no role attribute")
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.NoError(t, check("DeleteBook"))
+	require.EqualError(t, check("InitLedger"), "InitLedger: caller is not authorized as admin: role is librarian")
+	require.EqualError(t, check("DeleteEverything"), "no roles are declared for function DeleteEverything")
+	requireCode(t, check("InitLedger"), chaincode.CodeForbidden)
 }
 
-func TestDeleteBook(t *testing.T) {
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+func TestRegisterPatron(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	register := func(patron chaincode.Patron) error {
+		details, err := json.Marshal(&patron)
+		require.NoError(t, err)
+		return l.end(l.RegisterPatron(l.beginWith(map[string][]byte{"patronDetails": details})))
+	}
+	update := func(patron chaincode.Patron) error {
+		details, err := json.Marshal(&patron)
+		require.NoError(t, err)
+		return l.end(l.UpdatePatron(l.beginWith(map[string][]byte{"patronDetails": details})))
+	}
+	readPatron := func(id string) *chaincode.Patron {
+		patron, err := l.ReadPatron(l.begin(), id)
+		require.NoError(t, l.end(err))
+		return patron
+	}
+
+	require.EqualError(t, l.end(l.RegisterPatron(l.begin())), "transient data must contain patronDetails")
+	require.EqualError(t, register(chaincode.Patron{ID: "alice", Name: "Alice", Category: "adult"}), "borrowing limit must be positive, got 0")
 
-	asset := &chaincode.Book{ID: "B3"}
-	bytes, err := json.Marshal(asset)
+	require.NoError(t, register(chaincode.Patron{ID: "alice", Name: "Alice", Category: "adult", MaxLoans: 3}))
+	require.Empty(t, l.stub.Keys())
+	require.Equal(t, &events.PatronRegistered{Header: events.Header{Version: 1}, PatronRef: "tx3", Category: "adult", MaxLoans: 3}, l.lastEvent())
+	require.Equal(t, &chaincode.Patron{ID: "alice", Name: "Alice", Category: "adult", Status: chaincode.PatronActive, MaxLoans: 3, MSPID: "Org1MSP", Ref: "tx3", Version: 1}, readPatron("alice"))
+	require.EqualError(t, register(chaincode.Patron{ID: "alice", Name: "Alice", Category: "adult", MaxLoans: 3}), "the patron alice already exists")
+
+	err := update(chaincode.Patron{ID: "alice", Name: "Alice Smith", Category: "adult", MaxLoans: 5})
+	require.EqualError(t, err, "version conflict on patron alice: expected version 0, current version is 1")
+	require.NoError(t, update(chaincode.Patron{ID: "alice", Name: "Alice Smith", Category: "adult", MaxLoans: 5, Version: 1}))
+	require.Equal(t, &events.PatronUpdated{Header: events.Header{Version: 1}, PatronRef: "tx3", Category: "adult", MaxLoans: 5}, l.lastEvent())
+	require.NoError(t, l.end(l.SuspendPatron(l.beginWith(forPatron("alice")))))
+	require.Equal(t, &events.PatronSuspended{Header: events.Header{Version: 1}, PatronRef: "tx3"}, l.lastEvent())
+	require.NoError(t, l.end(l.ReinstatePatron(l.beginWith(forPatron("alice")))))
+	require.Equal(t, &events.PatronReinstated{Header: events.Header{Version: 1}, PatronRef: "tx3"}, l.lastEvent())
+	patron := readPatron("alice")
+	require.Equal(t, "Alice Smith", patron.Name)
+	require.EqualValues(t, 4, patron.Version)
+	require.NoError(t, register(chaincode.Patron{ID: "bob", Name: "Bob", Category: "adult", MaxLoans: 1, MSPID: "Org2MSP"}))
+
+	// Only members of the patron's organization act as the patron.
+	l.as("Org2MSP", "alice", map[string]string{"role": "patron"})
+	_, err = l.ReadPatron(l.begin(), "")
+	require.EqualError(t, l.end(err), "caller is not the patron alice: the patron belongs to Org1MSP, caller to Org2MSP")
+	l.as("Org2MSP", "bob", map[string]string{"role": "patron"})
+	require.Equal(t, "Org2MSP", readPatron("").MSPID)
+}
+
+func TestQueryBooks(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	l.put(
+		&chaincode.Book{ID: "B1", Name: "Book1", Publisher: "p1", Available: true},
+		&chaincode.Book{ID: "B2", Name: "Book2", Publisher: "p1"},
+		&chaincode.Book{ID: "B3", Name: "Book0", Publisher: "p1", Available: true},
+		&chaincode.Book{ID: "B4", Name: "Book4", Publisher: "p2", Available: true},
+		&chaincode.Book{ID: "B5", Name: "Book5", Publisher: "p1", Withdrawn: true},
+	)
+	query := func(queryJSON string) ([]*chaincode.Book, error) {
+		books, err := l.QueryBooks(l.begin(), queryJSON)
+		return books, l.end(err)
+	}
+	lastRichQuery := func() string {
+		queries := l.stub.RichQueries()
+		require.NotEmpty(t, queries)
+		return queries[len(queries)-1]
+	}
+
+	// LevelDB refuses rich queries, so the books are scanned instead.
+	books, err := query(`{"filter":{"publisher":"p1","available":true},"sort":["name"]}`)
 	require.NoError(t, err)
+	require.Len(t, books, 2)
+	require.Equal(t, "B3", books[0].ID)
+	require.Equal(t, "B1", books[1].ID)
+	require.Equal(t, `{"selector":{"available":true,"docType":"item","name":{"$gt":null},"publisher":"p1","withdrawn":{"$ne":true}},"sort":[{"docType":"asc"},{"name":"asc"}]}`, lastRichQuery())
 
-	chaincodeStub.GetStateReturns(bytes, nil)
-	chaincodeStub.DelStateReturns(nil)
-	assetTransfer := chaincode.SmartContract{}
-	err = assetTransfer.DeleteBook(transactionContext, "")
+	books, err = query(`{"filter":{"available":false}}`)
 	require.NoError(t, err)
+	require.Len(t, books, 1)
+	require.Equal(t, "B2", books[0].ID)
+	require.Equal(t, `{"selector":{"available":{"$ne":true},"docType":"item","withdrawn":{"$ne":true}}}`, lastRichQuery())
 
-	chaincodeStub.GetStateReturns(nil, nil)
-	err = assetTransfer.DeleteBook(transactionContext, "B3")
-	require.EqualError(t, err, "the asset asset3 does not exist")
+	books, err = query(`{"filter":{"withdrawn":true}}`)
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	require.Equal(t, "B5", books[0].ID)
 
-	chaincodeStub.GetStateReturns(nil, fmt.Errorf("unable to retrieve asset"))
-	err = assetTransfer.DeleteBook(transactionContext, "")
-	require.EqualError(t, err, "failed to read from world state: unable to retrieve asset")
+	books, err = query(`{"sort":["-publisher","-ID"]}`)
+	require.NoError(t, err)
+	require.Equal(t, "B4", books[0].ID)
+	require.Equal(t, "B3", books[1].ID)
+	require.Equal(t, "B1", books[3].ID)
+
+	_, err = query(`{"filter":{"borrower":"alice"}}`)
+	require.EqualError(t, err, `unknown query field "borrower"`)
+	_, err = query(`{"sort":["name","-ID"]}`)
+	require.EqualError(t, err, "sort fields must all have the same direction")
 }
 
-func TestTransferBook(t *testing.T) {
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+func TestPagination(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	for _, id := range []string{"B1", "B2", "B3", "B4", "B5"} {
+		l.put(&chaincode.Book{ID: id, Name: "Book" + id[1:]})
+	}
+	allBooks := func(pageSize int32, bookmark string) (*chaincode.BookPage, error) {
+		page, err := l.GetAllBooksWithPagination(l.begin(), pageSize, bookmark)
+		return page, l.end(err)
+	}
+	query := func(queryJSON string, pageSize int32, bookmark string) (*chaincode.BookPage, error) {
+		page, err := l.QueryBooksWithPagination(l.begin(), queryJSON, pageSize, bookmark)
+		return page, l.end(err)
+	}
 
-	asset := &chaincode.Book{ID: "B2"}
-	bytes, err := json.Marshal(asset)
+	page, err := allBooks(2, "")
+	require.NoError(t, err)
+	require.Len(t, page.Books, 2)
+	require.Equal(t, bookKey("B3"), page.Bookmark)
+	page, err = allBooks(4, page.Bookmark)
 	require.NoError(t, err)
+	require.Len(t, page.Books, 3)
+	require.Equal(t, "B3", page.Books[0].ID)
+	require.Empty(t, page.Bookmark)
 
-	chaincodeStub.GetStateReturns(bytes, nil)
-	assetTransfer := chaincode.SmartContract{}
-	err = assetTransfer.BorrowBook(transactionContext, "", "")
+	_, err = allBooks(0, "")
+	require.EqualError(t, err, "page size must be positive, got 0")
+
+	page, err = query(`{"sort":["-name"]}`, 3, "")
+	require.NoError(t, err)
+	require.Len(t, page.Books, 3)
+	require.Equal(t, "B5", page.Books[0].ID)
+	require.Equal(t, "B2", page.Bookmark)
+	page, err = query(`{"sort":["-name"]}`, 3, page.Bookmark)
 	require.NoError(t, err)
+	require.Len(t, page.Books, 2)
+	require.Equal(t, "B1", page.Books[1].ID)
+	require.Empty(t, page.Bookmark)
+	_, err = query(`{}`, 3, "B9")
+	require.EqualError(t, err, `invalid bookmark "B9"`)
+}
+
+func TestCreateBookAddsCopy(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	l.registerPatron("alice", 1)
+
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")))
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B7", "Book6", "Author6", "p2", "7111000064", "This is book 6")))
+	require.EqualError(t, l.end(l.CreateBook(l.begin(), "B7", "Book7", "Author7", "p2", "978-7-111-00007-5", "")), "the book B7 already exists")
+	require.EqualError(t, l.end(l.CreateBook(l.begin(), "B9", "Book9", "Author9", "p2", "111-1111111111", "")), `invalid ISBN "111-1111111111": ISBN-13 must start with 978 or 979`)
+
+	var item chaincode.Item
+	require.NoError(t, json.Unmarshal(l.stub.State(bookKey("B7")), &item))
+	require.NotContains(t, string(l.stub.State(bookKey("B7"))), "This is book 6")
+	book := l.readBook("B7")
+	require.Equal(t, "Book6", book.Name)
+	require.Equal(t, item.TitleID, book.TitleID)
+
+	require.NoError(t, l.end(l.AddCopy(l.begin(), item.TitleID, "B8")))
+	require.EqualError(t, l.end(l.AddCopy(l.begin(), "missing", "B9")), "the title missing does not exist")
+	l.borrow("alice", "B6")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+
+	title := l.readTitle(item.TitleID)
+	require.Equal(t, "Book6", title.Name)
+	require.Equal(t, 3, title.Copies)
+	require.Equal(t, 2, title.AvailableCopies)
+
+	require.NoError(t, l.end(l.UpdateBook(l.begin(), "B8", "Book8", "Author8", "p2", "978-7-111-00008-2", "This is book 8", true, 1)))
+	err := l.end(l.UpdateBook(l.begin(), "B8", "Book8", "Author8", "p2", "978-7-111-00008-2", "This is book 8", false, 1))
+	require.EqualError(t, err, "version conflict on book B8: expected version 1, current version is 2")
+	var conflict *chaincode.VersionConflictError
+	require.ErrorAs(t, err, &conflict)
+	requireCode(t, err, chaincode.CodeVersionConflict)
+	require.Equal(t, 2, l.readTitle(item.TitleID).Copies)
+	titles, err := l.GetAllTitles(l.begin())
+	require.NoError(t, l.end(err))
+	require.Len(t, titles, 2)
 
-	chaincodeStub.GetStateReturns(nil, fmt.Errorf("unable to retrieve asset"))
-	err = assetTransfer.BorrowBook(transactionContext, "", "")
-	require.EqualError(t, err, "failed to read from world state: unable to retrieve asset")
+	require.Len(t, l.booksByAuthor("Author6"), 2)
+	books, err := l.GetBooksByISBN(l.begin(), "7111000080")
+	require.NoError(t, l.end(err))
+	require.Len(t, books, 1)
+	require.Equal(t, "B8", books[0].ID)
+	books, err = l.GetBooksByPublisher(l.begin(), "p2")
+	require.NoError(t, l.end(err))
+	require.Len(t, books, 3)
+
+	require.NoError(t, l.end(l.DeleteBook(l.begin(), "B7")))
+	books = l.booksByAuthor("Author6")
+	require.Len(t, books, 1)
+	require.Equal(t, "B6", books[0].ID)
 }
 
-func TestGetAllBooks(t *testing.T) {
-	asset := &chaincode.Book{ID: "B1"}
-	bytes, err := json.Marshal(asset)
-	require.NoError(t, err)
+func TestGetBookHistory(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour})
+	l.registerPatron("alice", 1)
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")))
+	l.now = time.Unix(2000, 0)
+	l.borrow("alice", "B6")
+	loanID := l.storedBook("B6").LoanRef
+	l.now = time.Unix(3000, 0)
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B6")))
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.NoError(t, l.end(l.DeleteBook(l.begin(), "B6")))
 
-	iterator := &mocks.StateQueryIterator{}
-	iterator.HasNextReturnsOnCall(0, true)
-	iterator.HasNextReturnsOnCall(1, false)
-	iterator.NextReturns(&queryresult.KV{Value: bytes}, nil)
+	history, err := l.GetBookHistory(l.begin(), "B6")
+	require.NoError(t, l.end(err))
+	require.Len(t, history, 4)
 
-	chaincodeStub := &mocks.ChaincodeStub{}
-	transactionContext := &mocks.TransactionContext{}
-	transactionContext.GetStubReturns(chaincodeStub)
+	require.True(t, history[0].IsDelete)
+	require.Nil(t, history[0].Book)
+	require.EqualValues(t, 3000, history[0].Timestamp)
+	require.Contains(t, history[0].Changes, chaincode.FieldChange{Field: "ID", Old: `"B6"`})
 
-	chaincodeStub.GetStateByRangeReturns(iterator, nil)
-	assetTransfer := &chaincode.SmartContract{}
-	assets, err := assetTransfer.GetAllBooks(transactionContext)
-	require.NoError(t, err)
-	require.Equal(t, []*chaincode.Book{asset}, assets)
-
-	iterator.HasNextReturns(true)
-	iterator.NextReturns(nil, fmt.Errorf("failed retrieving next item"))
-	assets, err = assetTransfer.GetAllBooks(transactionContext)
-	require.EqualError(t, err, "failed retrieving next item")
-	require.Nil(t, assets)
-
-	chaincodeStub.GetStateByRangeReturns(nil, fmt.Errorf("failed retrieving all assets"))
-	assets, err = assetTransfer.GetAllBooks(transactionContext)
-	require.EqualError(t, err, "failed retrieving all assets")
-	require.Nil(t, assets)
+	require.Equal(t, loanID, history[2].TxID)
+	require.EqualValues(t, 2000, history[2].Timestamp)
+	require.Equal(t, []chaincode.FieldChange{
+		{Field: "available", Old: "true", New: "false"},
+		{Field: "dueTime", Old: "0", New: "5600"},
+		{Field: "loanRef", New: `"` + loanID + `"`},
+		{Field: "version", Old: "1", New: "2"},
+	}, history[2].Changes)
+
+	require.Equal(t, "Book6", history[3].Book.Name)
+	require.Contains(t, history[3].Changes, chaincode.FieldChange{Field: "ID", New: `"B6"`})
+
+	// Catalogue edits change the title, whose history shows them.
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B7", "Book7", "Author7", "p2", "978-7-111-00007-5", "This is book 7")))
+	titleID := l.storedBook("B7").TitleID
+	l.now = time.Unix(4000, 0)
+	require.NoError(t, l.end(l.PatchBook(l.begin(), "B7", `{"description":"A book about books"}`, 1)))
+	titleHistory, err := l.GetTitleHistory(l.begin(), titleID)
+	require.NoError(t, l.end(err))
+	require.Len(t, titleHistory, 2)
+	require.EqualValues(t, 4000, titleHistory[0].Timestamp)
+	require.Equal(t, []chaincode.FieldChange{
+		{Field: "description", Old: `"This is book 7"`, New: `"A book about books"`},
+		{Field: "version", Old: "1", New: "2"},
+	}, titleHistory[0].Changes)
+	require.Contains(t, titleHistory[1].Changes, chaincode.FieldChange{Field: "name", New: `"Book7"`})
+	_, err = l.GetTitleHistory(l.begin(), "missing")
+	require.EqualError(t, l.end(err), "the title missing does not exist")
+}
+
+func TestPatchBook(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")))
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B7", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")))
+	require.NoError(t, l.end(l.CreateBook(l.begin(), "B8", "Book8", "Author8", "p2", "978-7-111-00008-2", "This is book 8")))
+	patch := func(patchJSON string, version int64) error {
+		return l.end(l.PatchBook(l.begin(), "B6", patchJSON, version))
+	}
+
+	require.NoError(t, patch(`{"description":"Second edition"}`, 1))
+	book := l.readBook("B7")
+	require.Equal(t, "Second edition", book.Description)
+	require.True(t, book.Available)
+
+	// Changing the ISBN moves B6 to the title of B8 and keeps its description.
+	require.NoError(t, patch(`{"name":"Book8","author":"Author8","isbn":"7111000080"}`, 2))
+	updated := l.lastEvent().(*events.BookUpdated)
+	book = l.readBook("B6")
+	require.Equal(t, book.TitleID, updated.TitleID)
+	require.NotEqual(t, book.TitleID, updated.PreviousTitleID)
+	require.Equal(t, "Book8", updated.Name)
+	require.Equal(t, "Book8", book.Name)
+	require.Equal(t, "This is book 8", book.Description)
+	require.EqualValues(t, 3, book.Version)
+	require.Equal(t, 2, l.readTitle(book.TitleID).Copies)
+	require.Len(t, l.booksByAuthor("Author6"), 1)
+
+	for patchJSON, message := range map[string]string{
+		`{"available":false}`:          "available is loan state and cannot be patched",
+		`{"name":"x","loanRef":"t"}`:   "loanRef is loan state and cannot be patched",
+		`{"titleID":"t"}`:              "titleID cannot be patched",
+		`{"name":7}`:                   "name must be a string",
+		`{"isbn":"978-7-111-00008-3"}`: `invalid ISBN "978-7-111-00008-3": check digit is 3, want 2`,
+		`{}`:                           "the patch does not change any field",
+	} {
+		require.EqualError(t, patch(patchJSON, 3), message, patchJSON)
+	}
+	require.EqualError(t, patch(`{"description":"x"}`, 2), "version conflict on book B6: expected version 2, current version is 3")
+}
+
+func TestWithdrawBook(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	l.registerPatron("alice", 2)
+	l.registerPatron("bob", 1)
+	for _, id := range []string{"B6", "B7", "B8"} {
+		require.NoError(t, l.end(l.CreateBook(l.begin(), id, "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6")))
+	}
+	withdraw := func(id string, reason string, version int64) error {
+		return l.end(l.WithdrawBook(l.begin(), id, reason, version))
+	}
+	deleteBook := func(id string) error {
+		return l.end(l.DeleteBook(l.begin(), id))
+	}
+
+	// B7 is kept for bob and B8 is on loan.
+	l.borrow("alice", "B7")
+	l.asPatron("bob")
+	require.NoError(t, l.end(l.PlaceHold(l.begin(), "B7")))
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B7")))
+	l.borrow("alice", "B8")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+
+	require.EqualError(t, withdraw("B7", "damaged", 3), "the book B7 has holds and cannot be withdrawn")
+	require.EqualError(t, deleteBook("B7"), "the book B7 has holds and cannot be deleted")
+	require.EqualError(t, withdraw("B8", "damaged", 2), "the book B8 is on loan and cannot be withdrawn")
+	require.EqualError(t, deleteBook("B8"), "the book B8 is on loan and cannot be deleted")
+	require.EqualError(t, withdraw("B6", "", 1), "a reason is required to withdraw the book B6")
+
+	require.NoError(t, withdraw("B6", "damaged", 1))
+	withdrawn := l.lastEvent().(*events.BookWithdrawn)
+	require.Equal(t, "damaged", withdrawn.Reason)
+	require.EqualValues(t, 1000, withdrawn.WithdrawnTime)
+	book := l.readBook("B6")
+	require.True(t, book.Withdrawn)
+	require.False(t, book.Available)
+	require.Equal(t, "damaged", book.WithdrawnReason)
+	require.EqualValues(t, 1000, book.WithdrawnTime)
+	require.EqualError(t, withdraw("B6", "damaged", 2), "the book B6 has already been withdrawn")
+
+	// The withdrawn copy leaves its title and the indexes.
+	require.Equal(t, 2, l.readTitle(book.TitleID).Copies)
+	books := l.booksByAuthor("Author6")
+	require.Len(t, books, 2)
+	require.Equal(t, "B7", books[0].ID)
+
+	require.EqualError(t, l.end(l.BorrowBook(l.beginWith(forPatron("bob")), "B6")), "the book B6 has been withdrawn")
+	require.EqualError(t, l.end(l.PlaceHold(l.beginWith(forPatron("bob")), "B6")), "the book B6 has been withdrawn")
+	require.EqualError(t, l.end(l.UpdateBook(l.begin(), "B6", "Book6", "Author6", "p2", "978-7-111-00006-8", "This is book 6", true, 2)), "the book B6 has been withdrawn")
+	require.EqualError(t, l.end(l.PatchBook(l.begin(), "B6", `{"description":"x"}`, 2)), "the book B6 has been withdrawn")
+
+	require.NoError(t, deleteBook("B6"))
+	require.Nil(t, l.stub.State(bookKey("B6")))
+	require.Equal(t, &events.BookDeleted{Header: events.Header{Version: 1}, BookID: "B6", TitleID: book.TitleID}, l.lastEvent())
+}
+
+func TestLoanHistory(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour})
+	l.registerPatron("alice", 2)
+	l.registerPatron("bob", 2)
+
+	l.borrow("alice", "B1")
+	l.now = time.Unix(2000, 0)
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	l.now = time.Unix(3000, 0)
+	l.borrow("bob", "B1")
+	l.now = time.Unix(3500, 0)
+	l.borrow("alice", "B2")
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	records, err := l.GetLoanHistoryByBook(l.begin(), "B1")
+	require.NoError(t, l.end(err))
+	require.Len(t, records, 2)
+	require.Equal(t, "bob", records[0].Borrower)
+	require.EqualValues(t, 3000, records[0].LendingTime)
+	require.Zero(t, records[0].ReturnTime)
+	require.Equal(t, "alice", records[1].Borrower)
+	require.Equal(t, "Org1MSP/alice", records[1].IssuedBy)
+	require.EqualValues(t, 1000+3600, records[1].DueTime)
+	require.EqualValues(t, 2000, records[1].ReturnTime)
+
+	records, err = l.GetAllRecords(l.begin())
+	require.NoError(t, l.end(err))
+	require.Len(t, records, 3)
+	require.NotContains(t, string(l.stub.State(recordKey("B2", records[2].LoanID))), "alice")
+
+	l.now = time.Unix(7000, 0)
+	records, err = l.GetOverdueLoans(l.begin())
+	require.NoError(t, l.end(err))
+	require.Len(t, records, 1)
+	require.Equal(t, "B1", records[0].BookID)
+	records, err = l.GetLoansDueBefore(l.begin(), 8000)
+	require.NoError(t, l.end(err))
+	require.Len(t, records, 2)
+	require.Equal(t, "B2", records[1].BookID)
+
+	l.asPatron("alice")
+	records, err = l.GetLoanHistoryByBorrower(l.begin(), "")
+	require.NoError(t, l.end(err))
+	require.Len(t, records, 2)
+	require.Equal(t, "B2", records[0].BookID)
+	require.Equal(t, "B1", records[1].BookID)
+	_, err = l.GetLoanHistoryByBorrower(l.begin(), "bob")
+	require.EqualError(t, l.end(err), "cannot act for bob: caller is not authorized as admin or librarian: role is patron")
+}
+
+func TestFines(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour, FineBlockThreshold: cents(100)})
+	l.registerPatron("alice", 3)
+	l.borrow("alice", "B1")
+	l.borrow("alice", "B2")
+
+	// Due at 4600, returned two days and one second later.
+	l.now = time.Unix(4600+2*24*3600+1, 0)
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	require.Equal(t, int64(150), l.lastEvent().(*events.BookReturned).Fine)
+	err := l.end(l.BorrowBook(l.begin(), "B3"))
+	require.EqualError(t, err, "alice owes 150, which exceeds the borrowing limit of 100")
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.EqualError(t, l.end(l.PayFine(l.begin(), 100)), "transient data must contain patron")
+	require.EqualError(t, l.end(l.PayFine(l.beginWith(forPatron("alice")), 0)), "amount must be positive, got 0")
+	require.EqualError(t, l.end(l.PayFine(l.beginWith(forPatron("alice")), 200)), "payment of 200 exceeds the outstanding balance of 150 for alice")
+	require.NoError(t, l.end(l.PayFine(l.beginWith(forPatron("alice")), 100)))
+	paid := l.lastEvent().(*events.FinePaid)
+	require.EqualValues(t, 100, paid.Amount)
+	l.borrow("alice", "B3")
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	require.NoError(t, l.end(l.WaiveFine(l.beginWith(forPatron("alice")), 50, "first offence")))
+	require.Equal(t, "first offence", l.lastEvent().(*events.FineWaived).Reason)
+
+	// The fine of a loan is capped.
+	l.now = time.Unix(4600+100*24*3600, 0)
+	require.NoError(t, l.end(l.ReturnBook(l.beginWith(forPatron("alice")), "B2")))
+	require.Equal(t, int64(chaincode.DefaultFineCap), l.lastEvent().(*events.BookReturned).Fine)
+
+	balance, err := l.GetPatronBalance(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	require.EqualValues(t, chaincode.DefaultFineCap, balance.Balance)
+	require.Len(t, balance.Entries, 4)
+
+	l.asPatron("bob")
+	_, err = l.GetPatronBalance(l.begin(), "alice")
+	require.EqualError(t, l.end(err), "cannot act for alice: caller is not authorized as admin or librarian: role is patron")
+
+	// A library may charge no fines.
+	l = initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour, FineDailyRate: cents(0), LostItemFee: cents(0)})
+	l.registerPatron("alice", 2)
+	l.borrow("alice", "B1")
+	l.borrow("alice", "B2")
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	l.now = time.Unix(4600+2*24*3600+1, 0)
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	require.Zero(t, l.lastEvent().(*events.BookReturned).Fine)
+	require.NoError(t, l.end(l.ReportLost(l.begin(), "B2")))
+	require.Zero(t, l.lastEvent().(*events.BookLost).Fine)
+	balance, err = l.GetPatronBalance(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	require.Zero(t, balance.Balance)
+	require.Empty(t, balance.Entries)
+}
+
+func count(n int) *int {
+	return &n
+}
+
+func cents(n int64) *int64 {
+	return &n
+}
+
+func TestReportLost(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{LoanPeriod: time.Hour})
+	l.registerPatron("alice", 1)
+	l.registerPatron("bob", 1)
+	l.borrow("alice", "B1")
+	l.asPatron("bob")
+	require.NoError(t, l.end(l.PlaceHold(l.begin(), "B1")))
+	loanID := l.storedBook("B1").LoanRef
+
+	l.as("Org1MSP", "librarian1", map[string]string{"role": "librarian"})
+	l.now = time.Unix(4600+3600, 0)
+	require.NoError(t, l.end(l.ReportLost(l.begin(), "B1")))
+	require.Equal(t, &events.BookLost{Header: events.Header{Version: 1}, BookID: "B1", LoanID: loanID, ReportTime: 8200, Fine: 50 + chaincode.DefaultLostItemFee}, l.lastEvent())
+	require.EqualError(t, l.end(l.ReportLost(l.begin(), "B1")), "the book B1 is not borrowed")
+
+	book := l.readBook("B1")
+	require.True(t, book.Lost)
+	require.False(t, book.Available)
+	require.Empty(t, book.LoanRef)
+	require.Empty(t, l.holdQueue("B1"))
+	require.Zero(t, l.readTitle(book.TitleID).Copies)
+	patron, err := l.ReadPatron(l.begin(), "alice")
+	require.NoError(t, l.end(err))
+	require.Zero(t, patron.ActiveLoans)
+	records, err := l.GetLoanHistoryByBook(l.begin(), "B1")
+	require.NoError(t, l.end(err))
+	require.EqualValues(t, 50+chaincode.DefaultLostItemFee, records[0].Fine)
+
+	l.asPatron("bob")
+	require.EqualError(t, l.end(l.BorrowBook(l.begin(), "B1")), "the book B1 is lost")
+	require.EqualError(t, l.end(l.PlaceHold(l.begin(), "B1")), "the book B1 is lost")
+}
+
+func TestQueryBooksByPattern(t *testing.T) {
+	l := initLibrary(t, &chaincode.SmartContract{})
+	query := func(pattern string) []string {
+		books, err := l.QueryBooksByPattern(l.begin(), pattern)
+		require.NoError(t, l.end(err))
+		ids := []string{}
+		for _, book := range books {
+			ids = append(ids, book.ID)
+		}
+		return ids
+	}
+
+	require.Equal(t, []string{"B1", "B2", "B3", "B4", "B5"}, query("Book"))
+	require.Equal(t, []string{"B4", "B5"}, query("p2"))
+	require.Equal(t, []string{"B3"}, query("Author3"))
+	require.Equal(t, []string{"B2"}, query("978-7-111-00002-0"))
+	require.Empty(t, query("Book9"))
+
+	require.NoError(t, l.end(l.WithdrawBook(l.begin(), "B4", "damaged", 1)))
+	require.Equal(t, []string{"B5"}, query("p2"))
+
+	page, err := l.QueryBooksByPatternWithPagination(l.begin(), "Book", 2, "")
+	require.NoError(t, l.end(err))
+	require.Len(t, page.Books, 2)
+	require.Equal(t, bookKey("B3"), page.Bookmark)
+	page, err = l.QueryBooksByPatternWithPagination(l.begin(), "Book", 2, page.Bookmark)
+	require.NoError(t, l.end(err))
+	require.Equal(t, "B3", page.Books[0].ID)
+	require.Equal(t, "B5", page.Books[1].ID)
+	require.Empty(t, page.Bookmark)
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	l := newLibrary(t, &chaincode.SmartContract{})
+	l.registerPatron("alice", 2)
+	l.stub.Begin()
+	require.NoError(t, l.stub.PutState("B1", []byte(`{"ID":"B1","name":"Book1","author":"Author1","isbn":"978-7-111-00001-3","publisher":"p1","available":false,"borrower":"alice"}`)))
+	require.NoError(t, l.stub.PutState("B2", []byte(`{"ID":"B2","name":"Book2","author":"Author2","isbn":"9787111000020","publisher":"p1","available":true}`)))
+	require.NoError(t, l.stub.PutState("B3", []byte(`{"name":"Book3","author":"Author3","isbn":"9787111000037","publisher":"p1","available":false,"borrower":"alice"}`)))
+	require.NoError(t, l.stub.PutState("record-B1", []byte(`{"bookID":"B1","borrower":"alice","lendingTime":500}`)))
+	require.NoError(t, l.stub.PutState("record-B3", []byte(`{"bookID":"B3","borrower":"alice","lendingTime":600}`)))
+	require.NoError(t, l.stub.PutState("B4", []byte(`{"ID":"B4","name":"Book4","author":"Author4","isbn":"9787111000044","publisher":"p2","available":false,"borrower":"alice"}`)))
+	l.stub.Commit()
+
+	l.as("Org1MSP", "admin", map[string]string{"role": "admin"})
+	migrated, err := l.MigrateLegacyKeys(l.begin())
+	require.NoError(t, l.end(err))
+	require.Equal(t, &chaincode.MigratedKeys{Books: []string{"B1", "B2", "B3", "B4"}, Records: []string{"record-B1", "record-B3"}}, migrated)
+	for _, key := range []string{"B1", "B2", "B3", "B4", "record-B1", "record-B3"} {
+		require.Nil(t, l.stub.State(key))
+	}
+
+	book := l.readBook("B1")
+	require.Equal(t, "9787111000013", book.ISBN)
+	require.NotEmpty(t, book.TitleID)
+	require.Equal(t, "record-B1", book.LoanRef)
+	require.NotContains(t, string(l.stub.State(bookKey("B1"))), "alice")
+	require.Equal(t, "B1", l.booksByAuthor("Author1")[0].ID)
+
+	records, err := l.GetLoanHistoryByBook(l.begin(), "B1")
+	require.NoError(t, l.end(err))
+	require.Equal(t, []*chaincode.Record{{LoanID: "record-B1", BookID: "B1", Borrower: "alice", LendingTime: 500}}, records)
+
+	l.asPatron("alice")
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B1")))
+	require.True(t, l.readBook("B1").Available)
+
+	// A book stored without an ID takes it from its key.
+	book = l.readBook("B3")
+	require.Equal(t, "B3", book.ID)
+	require.Equal(t, "record-B3", book.LoanRef)
+	require.Equal(t, "B3", l.booksByAuthor("Author3")[0].ID)
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B3")))
+	require.True(t, l.readBook("B3").Available)
+
+	// A borrowed book whose record was never written gets one.
+	require.Equal(t, "record-B4", l.readBook("B4").LoanRef)
+	l.as("Org1MSP", "admin", map[string]string{"role": "admin"})
+	records, err = l.GetLoanHistoryByBook(l.begin(), "B4")
+	require.NoError(t, l.end(err))
+	require.Equal(t, []*chaincode.Record{{LoanID: "record-B4", BookID: "B4", Borrower: "alice"}}, records)
+	l.asPatron("alice")
+	require.NoError(t, l.end(l.ReturnBook(l.begin(), "B4")))
+	require.True(t, l.readBook("B4").Available)
 }
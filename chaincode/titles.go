@@ -0,0 +1,340 @@
+package chaincode
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/events"
+)
+
+const titleObjectType = "title"
+
+// Title is the bibliographic record shared by all copies of a book. Its ID
+// is derived from the name, author, publisher and ISBN.
+type Title struct {
+	ID          string `json:"ID"`
+	Name        string `json:"name"`
+	Author      string `json:"author"`
+	ISBN        string `json:"isbn"`
+	Publisher   string `json:"publisher"`
+	Description string `json:"description"`
+	Version     int64  `json:"version"`
+}
+
+// Item is one physical copy of a title. Its ID is the copy's barcode. World
+// state stores items, which are joined with their title into a Book when read.
+type Item struct {
+	// DocType is always itemDocType.
+	DocType string `json:"docType"`
+	ID      string `json:"ID"`
+	TitleID string `json:"titleID"`
+	// Name, Author, ISBN and Publisher are copied from the title so CouchDB
+	// can query them. They determine the title ID and so never change.
+	Name       string `json:"name"`
+	Author     string `json:"author"`
+	ISBN       string `json:"isbn"`
+	Publisher  string `json:"publisher"`
+	Available  bool   `json:"available"`
+	LoanRef    string `json:"loanRef,omitempty" metadata:",optional"`
+	DueTime    int64  `json:"dueTime"`
+	Renewals   int    `json:"renewals"`
+	HoldExpiry int64  `json:"holdExpiry"`
+	Lost       bool   `json:"lost,omitempty" metadata:",optional"`
+
+	Withdrawn       bool   `json:"withdrawn,omitempty" metadata:",optional"`
+	WithdrawnReason string `json:"withdrawnReason,omitempty" metadata:",optional"`
+	WithdrawnTime   int64  `json:"withdrawnTime,omitempty" metadata:",optional"`
+	Version         int64  `json:"version"`
+}
+
+// TitleAvailability is a title with the number of its copies. The counts are
+// computed when the title is read and never stored.
+type TitleAvailability struct {
+	Title
+	// Copies counts the copies that are not lost.
+	Copies          int `json:"copies"`
+	AvailableCopies int `json:"availableCopies"`
+}
+
+// AddCopy adds a copy with the given barcode to an existing title.
+func (s *SmartContract) AddCopy(ctx contractapi.TransactionContextInterface, titleID string, id string) error {
+	title, err := getTitle(ctx, titleID)
+	if err != nil {
+		return err
+	}
+	if title == nil {
+		return notFound("the title %s does not exist", titleID)
+	}
+	exists, err := s.BookExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return conflict("the book %s already exists", id)
+	}
+
+	if err := putBookIndexes(ctx, title, id); err != nil {
+		return err
+	}
+	book := &Book{ID: id, Available: true}
+	book.applyTitle(title)
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), bookCreated(book))
+}
+
+// ReadTitle returns the title with given id and how many of its copies are
+// available.
+func (s *SmartContract) ReadTitle(ctx contractapi.TransactionContextInterface, titleID string) (*TitleAvailability, error) {
+	title, err := getTitle(ctx, titleID)
+	if err != nil {
+		return nil, err
+	}
+	if title == nil {
+		return nil, notFound("the title %s does not exist", titleID)
+	}
+
+	return s.titleAvailability(ctx, title)
+}
+
+// GetAllTitles returns all titles with how many of their copies are available.
+func (s *SmartContract) GetAllTitles(ctx contractapi.TransactionContextInterface) ([]*TitleAvailability, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(titleObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	titles := []*TitleAvailability{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var title Title
+		err = json.Unmarshal(queryResponse.Value, &title)
+		if err != nil {
+			return nil, err
+		}
+		availability, err := s.titleAvailability(ctx, &title)
+		if err != nil {
+			return nil, err
+		}
+		titles = append(titles, availability)
+	}
+
+	return titles, nil
+}
+
+// GetTitleCopies returns all copies of a title.
+func (s *SmartContract) GetTitleCopies(ctx contractapi.TransactionContextInterface, titleID string) ([]*Book, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(titleItemIndex, []string{titleID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	books := []*Book{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		book, err := s.ReadBook(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+
+	return books, nil
+}
+
+func (s *SmartContract) titleAvailability(ctx contractapi.TransactionContextInterface, title *Title) (*TitleAvailability, error) {
+	books, err := s.GetTitleCopies(ctx, title.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	availability := &TitleAvailability{Title: *title}
+	for _, book := range books {
+		if book.Lost {
+			continue
+		}
+		availability.Copies++
+		if book.Available {
+			availability.AvailableCopies++
+		}
+	}
+	return availability, nil
+}
+
+// linkTitle attaches book to the title matching its details, creating the
+// title when it does not exist yet.
+func (s *SmartContract) linkTitle(ctx contractapi.TransactionContextInterface, book *Book) error {
+	id := titleID(book.Name, book.Author, book.Publisher, book.ISBN)
+	title, err := getTitle(ctx, id)
+	if err != nil {
+		return err
+	}
+	if title == nil {
+		title = &Title{
+			ID:          id,
+			Name:        book.Name,
+			Author:      book.Author,
+			ISBN:        book.ISBN,
+			Publisher:   book.Publisher,
+			Description: book.Description,
+		}
+		if err := putTitle(ctx, title); err != nil {
+			return err
+		}
+	}
+
+	if err := putBookIndexes(ctx, title, book.ID); err != nil {
+		return err
+	}
+	book.applyTitle(title)
+	return nil
+}
+
+// retitle stores title, keeping the version of an existing title with the
+// same ID, and makes book a copy of it. The book's index entries move when
+// its title changes. The caller stores the book.
+func (s *SmartContract) retitle(ctx contractapi.TransactionContextInterface, book *Book, title *Title) error {
+	existing, err := getTitle(ctx, title.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		title.Version = existing.Version
+	}
+	if err := putTitle(ctx, title); err != nil {
+		return err
+	}
+	if book.TitleID != title.ID {
+		if err := deleteBookIndexes(ctx, book.TitleID, book.ID); err != nil {
+			return err
+		}
+		if err := putBookIndexes(ctx, title, book.ID); err != nil {
+			return err
+		}
+	}
+
+	book.applyTitle(title)
+	return nil
+}
+
+// item returns the copy state of a book.
+func (b *Book) item() *Item {
+	return &Item{
+		DocType:    itemDocType,
+		ID:         b.ID,
+		TitleID:    b.TitleID,
+		Name:       b.Name,
+		Author:     b.Author,
+		ISBN:       b.ISBN,
+		Publisher:  b.Publisher,
+		Available:  b.Available,
+		LoanRef:    b.LoanRef,
+		DueTime:    b.DueTime,
+		Renewals:   b.Renewals,
+		HoldExpiry: b.HoldExpiry,
+		Lost:       b.Lost,
+
+		Withdrawn:       b.Withdrawn,
+		WithdrawnReason: b.WithdrawnReason,
+		WithdrawnTime:   b.WithdrawnTime,
+		Version:         b.Version,
+	}
+}
+
+// applyTitle fills in the bibliographic details of a book from its title.
+func (b *Book) applyTitle(title *Title) {
+	b.TitleID = title.ID
+	b.BookKey = title.ID
+	b.Name = title.Name
+	b.Author = title.Author
+	b.ISBN = title.ISBN
+	b.Publisher = title.Publisher
+	b.Description = title.Description
+}
+
+func bookCreated(b *Book) *events.BookCreated {
+	return &events.BookCreated{
+		BookID:    b.ID,
+		TitleID:   b.TitleID,
+		Name:      b.Name,
+		Author:    b.Author,
+		ISBN:      b.ISBN,
+		Publisher: b.Publisher,
+	}
+}
+
+func bookUpdated(b *Book, previousTitleID string) *events.BookUpdated {
+	return &events.BookUpdated{
+		BookID:          b.ID,
+		TitleID:         b.TitleID,
+		PreviousTitleID: previousTitleID,
+		Name:            b.Name,
+		Author:          b.Author,
+		ISBN:            b.ISBN,
+		Publisher:       b.Publisher,
+		Available:       b.Available,
+	}
+}
+
+// titleID derives the ID of the title with the given details.
+func titleID(name string, author string, publisher string, isbn string) string {
+	hash := md5.Sum([]byte(fmt.Sprintf("%s|%s|%s|%s", name, author, publisher, isbn)))
+	return hex.EncodeToString(hash[:])
+}
+
+// getTitle returns the stored title, or nil when it does not exist.
+func getTitle(ctx contractapi.TransactionContextInterface, id string) (*Title, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(titleObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	titleJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if titleJSON == nil {
+		return nil, nil
+	}
+
+	var title Title
+	err = json.Unmarshal(titleJSON, &title)
+	if err != nil {
+		return nil, err
+	}
+
+	return &title, nil
+}
+
+// putTitle stores a title as its next version.
+func putTitle(ctx contractapi.TransactionContextInterface, title *Title) error {
+	title.Version++
+	key, err := ctx.GetStub().CreateCompositeKey(titleObjectType, []string{title.ID})
+	if err != nil {
+		return err
+	}
+	titleJSON, err := json.Marshal(title)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, titleJSON)
+}
@@ -0,0 +1,31 @@
+package chaincode
+
+import "fmt"
+
+// Every stored entity carries a Version that is incremented each time it is
+// written, starting at 1. Entities written before versions existed read as
+// version 0. Update transactions take the version the client last read and
+// fail with a VersionConflictError when the entity has changed since.
+
+// VersionConflictError is returned when an update is based on a version of
+// an entity that is no longer current. Clients should read the entity again
+// and retry.
+type VersionConflictError struct {
+	Entity   string
+	ID       string
+	Expected int64
+	Current  int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on %s %s: expected version %d, current version is %d", e.Entity, e.ID, e.Expected, e.Current)
+}
+
+// checkVersion returns a VersionConflictError, reported with the code
+// version_conflict, when expected is not the current version of an entity.
+func checkVersion(entity string, id string, expected int64, current int64) error {
+	if expected != current {
+		return withCode(CodeVersionConflict, &VersionConflictError{Entity: entity, ID: id, Expected: expected, Current: current})
+	}
+	return nil
+}
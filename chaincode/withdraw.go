@@ -0,0 +1,58 @@
+package chaincode
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/yunlong-le/library/clock"
+	"github.com/yunlong-le/library/events"
+)
+
+// WithdrawBook retires a book from the collection. The book stays in world
+// state with the reason and time of the withdrawal so its history can still
+// be read, but it is removed from its title and the book indexes and can no
+// longer be borrowed, held or found by QueryBooks. A book that is on loan or
+// has holds cannot be withdrawn. version is the version of the book the
+// withdrawal is based on.
+func (s *SmartContract) WithdrawBook(ctx contractapi.TransactionContextInterface, id string, reason string, version int64) error {
+	if strings.TrimSpace(reason) == "" {
+		return invalid("a reason is required to withdraw the book %s", id)
+	}
+	book, err := s.storedBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion("book", id, version, book.Version); err != nil {
+		return err
+	}
+	if book.Withdrawn {
+		return conflict("the book %s has already been withdrawn", id)
+	}
+	if book.LoanRef != "" {
+		return conflict("the book %s is on loan and cannot be withdrawn", id)
+	}
+	holds, err := s.holdQueue(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(holds) > 0 {
+		return conflict("the book %s has holds and cannot be withdrawn", id)
+	}
+
+	now, err := clock.Or(s.Clock).Now(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	if err := deleteBookIndexes(ctx, book.TitleID, id); err != nil {
+		return err
+	}
+	book.Available = false
+	book.Withdrawn = true
+	book.WithdrawnReason = reason
+	book.WithdrawnTime = now.Unix()
+	if err := s.putBook(ctx, book); err != nil {
+		return err
+	}
+
+	return events.Emit(ctx.GetStub(), &events.BookWithdrawn{BookID: id, TitleID: book.TitleID, Reason: reason, WithdrawnTime: book.WithdrawnTime})
+}
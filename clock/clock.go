@@ -0,0 +1,73 @@
+// Package clock supplies the transaction time used by the library chaincodes.
+//
+// Chaincode must never read the wall clock of the peer: every endorsing peer
+// executes the proposal independently, and any difference in the values they
+// write makes the endorsements mismatch. The proposal timestamp chosen by the
+// client is the same on every peer, so production code uses TxClock. Tests
+// can swap in Fixed or Advancing to control time explicitly.
+package clock
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// Clock returns the current time of a transaction.
+type Clock interface {
+	Now(stub shim.ChaincodeStubInterface) (time.Time, error)
+}
+
+// TxClock reads the timestamp of the transaction proposal.
+type TxClock struct{}
+
+// Now returns the proposal timestamp of the transaction running on stub.
+func (TxClock) Now(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	if timestamp == nil {
+		return time.Time{}, fmt.Errorf("transaction timestamp is not set")
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// Fixed always returns the same time.
+type Fixed time.Time
+
+// Now returns the fixed time.
+func (c Fixed) Now(shim.ChaincodeStubInterface) (time.Time, error) {
+	return time.Time(c), nil
+}
+
+// Advancing moves forward by Step whenever a new transaction reads it, so
+// each transaction observes a later time than the one before while all reads
+// within one transaction agree. The first transaction observes Current.
+type Advancing struct {
+	Current time.Time
+	Step    time.Duration
+
+	txID    string
+	started bool
+}
+
+// Now returns the time of the transaction running on stub.
+func (c *Advancing) Now(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txID := stub.GetTxID()
+	if c.started && txID != c.txID {
+		c.Current = c.Current.Add(c.Step)
+	}
+	c.started = true
+	c.txID = txID
+	return c.Current, nil
+}
+
+// Or returns c, or TxClock when c is nil.
+func Or(c Clock) Clock {
+	if c == nil {
+		return TxClock{}
+	}
+	return c
+}
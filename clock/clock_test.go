@@ -0,0 +1,48 @@
+package clock_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/clock"
+)
+
+func TestTxClock(t *testing.T) {
+	stub := shimtest.NewMockStub("clock", nil)
+	_, err := clock.TxClock{}.Now(stub)
+	require.EqualError(t, err, "failed to get transaction timestamp: TxTimestamp not set")
+
+	stub.TxTimestamp = &timestamp.Timestamp{Seconds: 1700000000, Nanos: 500}
+	now, err := clock.TxClock{}.Now(stub)
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(1700000000, 500).UTC(), now)
+}
+
+func TestFixedAndAdvancing(t *testing.T) {
+	start := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+
+	fixed := clock.Fixed(start)
+	for i := 0; i < 2; i++ {
+		now, err := fixed.Now(nil)
+		require.NoError(t, err)
+		require.Equal(t, start, now)
+	}
+
+	stub := shimtest.NewMockStub("clock", nil)
+	advancing := &clock.Advancing{Current: start, Step: time.Minute}
+	for i := 0; i < 3; i++ {
+		stub.TxID = fmt.Sprintf("tx%d", i)
+		for j := 0; j < 2; j++ {
+			now, err := advancing.Now(stub)
+			require.NoError(t, err)
+			require.Equal(t, start.Add(time.Duration(i)*time.Minute), now)
+		}
+	}
+
+	require.Equal(t, clock.TxClock{}, clock.Or(nil))
+	require.Equal(t, fixed, clock.Or(fixed))
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Roles of API callers.
+const (
+	LibrarianRole = "librarian"
+	PatronRole    = "patron"
+)
+
+// Caller is an authenticated client of the API. Every transaction runs as
+// the server's own identity, so the server itself limits patrons to their
+// own loans, holds and records.
+type Caller struct {
+	Role string `json:"role"`
+	// Patron is the patron a caller with the patron role acts as.
+	Patron string `json:"patron,omitempty"`
+}
+
+func (c *Caller) isStaff() bool {
+	return c.Role == LibrarianRole
+}
+
+// ParseTokens reads the callers of the API from a JSON object mapping bearer
+// tokens to callers:
+//
+//	{"<token>": {"role": "librarian"}, "<token>": {"role": "patron", "patron": "alice"}}
+func ParseTokens(data []byte) (map[string]Caller, error) {
+	var tokens map[string]Caller
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tokens: %v", err)
+	}
+	for token, caller := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("tokens must not be empty")
+		}
+		switch caller.Role {
+		case LibrarianRole:
+			if caller.Patron != "" {
+				return nil, fmt.Errorf("a librarian token must not name a patron")
+			}
+		case PatronRole:
+			if caller.Patron == "" {
+				return nil, fmt.Errorf("a patron token must name a patron")
+			}
+		default:
+			return nil, fmt.Errorf("role must be %s or %s, got %q", LibrarianRole, PatronRole, caller.Role)
+		}
+	}
+	return tokens, nil
+}
+
+type callerKey struct{}
+
+// authenticate returns the caller named by the request's bearer token.
+func (s *Server) authenticate(r *http.Request) (*Caller, error) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || token == "" {
+		return nil, &requestError{http.StatusUnauthorized, "the request has no bearer token"}
+	}
+	caller, ok := s.tokens[token]
+	if !ok {
+		return nil, &requestError{http.StatusUnauthorized, "the bearer token is not valid"}
+	}
+	return &caller, nil
+}
+
+func callerOf(r *http.Request) *Caller {
+	return r.Context().Value(callerKey{}).(*Caller)
+}
+
+func withCaller(r *http.Request, caller *Caller) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+}
+
+func forbidden(format string, args ...interface{}) error {
+	return &requestError{http.StatusForbidden, fmt.Sprintf(format, args...)}
+}
+
+// staffOnly wraps a handler that only librarians may call.
+func staffOnly(handle handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params []string) error {
+		if caller := callerOf(r); !caller.isStaff() {
+			return forbidden("caller is not authorized as %s: role is %s", LibrarianRole, caller.Role)
+		}
+		return handle(w, r, params)
+	}
+}
+
+// actFor returns the patron a transaction acts for. Librarians act for any
+// patron, or for the server's identity when patron is empty; patrons only
+// act for themselves.
+func actFor(r *http.Request, patron string) (string, error) {
+	caller := callerOf(r)
+	if caller.isStaff() || patron == caller.Patron {
+		return patron, nil
+	}
+	if patron == "" {
+		return caller.Patron, nil
+	}
+	return "", forbidden("cannot act for %s: caller is the patron %s", patron, caller.Patron)
+}
@@ -0,0 +1,79 @@
+// Package api serves the library chaincode as a JSON HTTP API, so that web
+// and kiosk clients do not need a Fabric SDK.
+//
+// Each endpoint maps to one transaction of the chaincode served by the
+// repository's main package. The server calls the chaincode as its own
+// identity, which should hold the librarian role; the patron a transaction
+// acts for is passed in the transient data, as the chaincode expects.
+//
+// Because the chaincode sees only the server's identity, the server checks
+// its callers itself. Every request carries a bearer token naming a
+// librarian or a patron; librarians may call every endpoint, while patrons
+// only borrow, renew, hold and read for themselves.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Transaction is a call to the chaincode.
+type Transaction struct {
+	Name string
+	Args []string
+	// Transient is passed as the transient data of the proposal and is not
+	// written to the ledger.
+	Transient map[string][]byte
+}
+
+// Backend runs transactions of the library chaincode.
+type Backend interface {
+	// Submit runs a transaction that updates the ledger and waits for it to
+	// be committed.
+	Submit(ctx context.Context, tx *Transaction) ([]byte, error)
+	// Evaluate runs a query without updating the ledger.
+	Evaluate(ctx context.Context, tx *Transaction) ([]byte, error)
+}
+
+// ChaincodeError is returned by a Backend when the chaincode rejects a
+// transaction. Any other error means the chaincode could not be reached.
+type ChaincodeError struct {
+	// Code classifies the rejection, as one of the codes of the chaincode's
+	// Error type. It is empty for internal errors of the chaincode.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewChaincodeError returns the error the chaincode reported with message.
+// The chaincode reports a rejection as a JSON object with its code and
+// message; any other message is kept whole, without a code.
+func NewChaincodeError(message string) *ChaincodeError {
+	var e ChaincodeError
+	if err := json.Unmarshal([]byte(message), &e); err != nil || e.Message == "" {
+		return &ChaincodeError{Message: message}
+	}
+	return &e
+}
+
+func (e *ChaincodeError) Error() string {
+	return e.Message
+}
+
+// StatusCode is the HTTP status for the code of the chaincode error. Errors
+// without a code, such as failures to read or write the ledger, are internal
+// errors.
+func (e *ChaincodeError) StatusCode() int {
+	switch e.Code {
+	case "invalid":
+		return http.StatusBadRequest
+	case "not_found":
+		return http.StatusNotFound
+	case "forbidden":
+		return http.StatusForbidden
+	case "conflict", "version_conflict":
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
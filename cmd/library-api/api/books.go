@@ -0,0 +1,261 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// newBook is the body of POST /books.
+type newBook struct {
+	ID          string `json:"ID"`
+	Name        string `json:"name"`
+	Author      string `json:"author"`
+	Publisher   string `json:"publisher"`
+	ISBN        string `json:"isbn"`
+	Description string `json:"description"`
+}
+
+// bookDetails is the body of PUT /books/{id}. Version is the version of the
+// book the update is based on.
+type bookDetails struct {
+	Name        string `json:"name"`
+	Author      string `json:"author"`
+	Publisher   string `json:"publisher"`
+	ISBN        string `json:"isbn"`
+	Description string `json:"description"`
+	Available   bool   `json:"available"`
+	Version     int64  `json:"version"`
+}
+
+type withdrawal struct {
+	Reason string `json:"reason"`
+}
+
+type newCopy struct {
+	BookID string `json:"bookID"`
+}
+
+// Book endpoints; only librarians may change books or read their history
+// and loans:
+//
+//	GET    /books                all books; ?q= matches a pattern, ?isbn=, ?author=
+//	                             and ?publisher= use the indexes, and ?pageSize=
+//	                             with ?bookmark= reads one page
+//	POST   /books                add a book
+//	POST   /books/search         query books with a BookQuery JSON body
+//	GET    /books/{id}           read a book
+//	PUT    /books/{id}           replace the catalogue details of a book
+//	PATCH  /books/{id}           change some catalogue fields of a book
+//	DELETE /books/{id}           delete a book
+//	POST   /books/{id}/withdraw  withdraw a book from circulation
+//	GET    /books/{id}/history   changes to a book
+//	GET    /books/{id}/loans     loans of a book
+//
+// Changes are based on the version of the book the client last read, given
+// in the body of PUT and in the If-Match header of PATCH and withdraw. They
+// fail with 409 Conflict when the book has changed since.
+func (s *Server) addBookRoutes() {
+	s.handle(http.MethodGet, "/books", s.listBooks)
+	s.handle(http.MethodPost, "/books", staffOnly(s.addBook))
+	s.handle(http.MethodPost, "/books/search", s.searchBooks)
+	s.handle(http.MethodGet, "/books/:id", func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "ReadBook", params[0])
+	})
+	s.handle(http.MethodPut, "/books/:id", staffOnly(s.updateBook))
+	s.handle(http.MethodPatch, "/books/:id", staffOnly(s.patchBook))
+	s.handle(http.MethodDelete, "/books/:id", staffOnly(func(w http.ResponseWriter, r *http.Request, params []string) error {
+		if err := s.submit(r, "DeleteBook", nil, params[0]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	s.handle(http.MethodPost, "/books/:id/withdraw", staffOnly(s.withdrawBook))
+	s.handle(http.MethodGet, "/books/:id/history", staffOnly(func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "GetBookHistory", params[0])
+	}))
+	s.handle(http.MethodGet, "/books/:id/loans", staffOnly(func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "GetLoanHistoryByBook", params[0])
+	}))
+}
+
+// Title endpoints; only librarians may add copies and read the history:
+//
+//	GET  /titles               all titles with their number of copies
+//	GET  /titles/{id}          read a title
+//	GET  /titles/{id}/history  changes to a title, such as edits of the
+//	                           catalogue details of its books
+//	GET  /titles/{id}/copies   copies of a title
+//	POST /titles/{id}/copies   add a copy of a title
+func (s *Server) addTitleRoutes() {
+	s.handle(http.MethodGet, "/titles", func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "GetAllTitles")
+	})
+	s.handle(http.MethodGet, "/titles/:id", func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "ReadTitle", params[0])
+	})
+	s.handle(http.MethodGet, "/titles/:id/history", staffOnly(func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "GetTitleHistory", params[0])
+	}))
+	s.handle(http.MethodGet, "/titles/:id/copies", func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "GetTitleCopies", params[0])
+	})
+	s.handle(http.MethodPost, "/titles/:id/copies", staffOnly(s.addCopy))
+}
+
+func (s *Server) listBooks(w http.ResponseWriter, r *http.Request, params []string) error {
+	values := r.URL.Query()
+	var filter, value string
+	for _, name := range []string{"q", "isbn", "author", "publisher"} {
+		if !values.Has(name) {
+			continue
+		}
+		if filter != "" {
+			return badRequest("cannot filter by both %s and %s", filter, name)
+		}
+		filter, value = name, values.Get(name)
+	}
+
+	if values.Has("pageSize") {
+		pageSize, err := pageSize(values)
+		if err != nil {
+			return err
+		}
+		switch filter {
+		case "":
+			return s.query(w, r, http.StatusOK, "GetAllBooksWithPagination", pageSize, values.Get("bookmark"))
+		case "q":
+			return s.query(w, r, http.StatusOK, "QueryBooksByPatternWithPagination", value, pageSize, values.Get("bookmark"))
+		default:
+			return badRequest("%s cannot be paginated", filter)
+		}
+	}
+
+	switch filter {
+	case "q":
+		return s.query(w, r, http.StatusOK, "QueryBooksByPattern", value)
+	case "isbn":
+		return s.query(w, r, http.StatusOK, "GetBooksByISBN", value)
+	case "author":
+		return s.query(w, r, http.StatusOK, "GetBooksByAuthor", value)
+	case "publisher":
+		return s.query(w, r, http.StatusOK, "GetBooksByPublisher", value)
+	default:
+		return s.query(w, r, http.StatusOK, "GetAllBooks")
+	}
+}
+
+func (s *Server) addBook(w http.ResponseWriter, r *http.Request, params []string) error {
+	var book newBook
+	if err := readJSON(r, &book); err != nil {
+		return err
+	}
+	if book.ID == "" {
+		return badRequest("book ID must not be empty")
+	}
+	if err := s.submit(r, "CreateBook", nil, book.ID, book.Name, book.Author, book.Publisher, book.ISBN, book.Description); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/books/"+url.PathEscape(book.ID))
+	return s.query(w, r, http.StatusCreated, "ReadBook", book.ID)
+}
+
+func (s *Server) searchBooks(w http.ResponseWriter, r *http.Request, params []string) error {
+	query, err := readRawJSON(r)
+	if err != nil {
+		return err
+	}
+	values := r.URL.Query()
+	if !values.Has("pageSize") {
+		return s.query(w, r, http.StatusOK, "QueryBooks", query)
+	}
+	pageSize, err := pageSize(values)
+	if err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "QueryBooksWithPagination", query, pageSize, values.Get("bookmark"))
+}
+
+func (s *Server) updateBook(w http.ResponseWriter, r *http.Request, params []string) error {
+	var book bookDetails
+	if err := readJSON(r, &book); err != nil {
+		return err
+	}
+	err := s.submit(r, "UpdateBook", nil, params[0], book.Name, book.Author, book.Publisher, book.ISBN, book.Description,
+		strconv.FormatBool(book.Available), strconv.FormatInt(book.Version, 10))
+	if err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "ReadBook", params[0])
+}
+
+func (s *Server) patchBook(w http.ResponseWriter, r *http.Request, params []string) error {
+	version, err := ifMatch(r)
+	if err != nil {
+		return err
+	}
+	patch, err := readRawJSON(r)
+	if err != nil {
+		return err
+	}
+	if err := s.submit(r, "PatchBook", nil, params[0], patch, version); err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "ReadBook", params[0])
+}
+
+func (s *Server) withdrawBook(w http.ResponseWriter, r *http.Request, params []string) error {
+	version, err := ifMatch(r)
+	if err != nil {
+		return err
+	}
+	var body withdrawal
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	if err := s.submit(r, "WithdrawBook", nil, params[0], body.Reason, version); err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "ReadBook", params[0])
+}
+
+// ifMatch returns the version of the book given by the If-Match header,
+// either bare or as an entity tag such as "3".
+func ifMatch(r *http.Request) (string, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return "", &requestError{http.StatusPreconditionRequired, "the If-Match header must give the version of the book"}
+	}
+	version := strings.TrimSuffix(strings.TrimPrefix(header, `"`), `"`)
+	if _, err := strconv.ParseInt(version, 10, 64); err != nil {
+		return "", badRequest("If-Match must be the version of the book, got %s", header)
+	}
+	return version, nil
+}
+
+func (s *Server) addCopy(w http.ResponseWriter, r *http.Request, params []string) error {
+	var body newCopy
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	if body.BookID == "" {
+		return badRequest("book ID must not be empty")
+	}
+	if err := s.submit(r, "AddCopy", nil, params[0], body.BookID); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/books/"+url.PathEscape(body.BookID))
+	return s.query(w, r, http.StatusCreated, "ReadBook", body.BookID)
+}
+
+// pageSize returns the pageSize query parameter, which must be a positive
+// integer.
+func pageSize(values url.Values) (string, error) {
+	size, err := strconv.ParseInt(values.Get("pageSize"), 10, 32)
+	if err != nil || size <= 0 {
+		return "", badRequest("pageSize must be a positive integer, got %q", values.Get("pageSize"))
+	}
+	return strconv.FormatInt(size, 10), nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import "net/http"
+
+// newHold is the body of POST /books/{id}/holds.
+type newHold struct {
+	// Patron places the hold; the chaincode places it for the caller when it
+	// is empty.
+	Patron string `json:"patron"`
+}
+
+// Hold endpoints. Patrons place and cancel only their own holds, and only
+// librarians may read the queue:
+//
+//	GET    /books/{id}/holds           the hold queue of a book
+//	POST   /books/{id}/holds           place a hold on a book; patrons get no
+//	                                   body, as the queue names other patrons
+//	DELETE /books/{id}/holds/{patron}  cancel the hold of a patron
+//	POST   /books/{id}/expire-hold     end a hold whose pickup window lapsed
+func (s *Server) addHoldRoutes() {
+	s.handle(http.MethodGet, "/books/:id/holds", staffOnly(func(w http.ResponseWriter, r *http.Request, params []string) error {
+		return s.query(w, r, http.StatusOK, "GetHoldQueue", params[0])
+	}))
+	s.handle(http.MethodPost, "/books/:id/holds", s.placeHold)
+	s.handle(http.MethodDelete, "/books/:id/holds/:patron", s.cancelHold)
+	s.handle(http.MethodPost, "/books/:id/expire-hold", func(w http.ResponseWriter, r *http.Request, params []string) error {
+		if err := s.submit(r, "ExpireHold", nil, params[0]); err != nil {
+			return err
+		}
+		return s.query(w, r, http.StatusOK, "ReadBook", params[0])
+	})
+}
+
+func (s *Server) placeHold(w http.ResponseWriter, r *http.Request, params []string) error {
+	var hold newHold
+	if err := readJSON(r, &hold); err != nil {
+		return err
+	}
+	patron, err := actFor(r, hold.Patron)
+	if err != nil {
+		return err
+	}
+	if err := s.submit(r, "PlaceHold", forPatron(patron), params[0]); err != nil {
+		return err
+	}
+	if !callerOf(r).isStaff() {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return s.query(w, r, http.StatusCreated, "GetHoldQueue", params[0])
+}
+
+func (s *Server) cancelHold(w http.ResponseWriter, r *http.Request, params []string) error {
+	patron, err := actFor(r, params[1])
+	if err != nil {
+		return err
+	}
+	if err := s.submit(r, "CancelHold", forPatron(patron), params[0]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
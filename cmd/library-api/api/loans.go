@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// newLoan is the body of POST /loans.
+type newLoan struct {
+	BookID string `json:"bookID"`
+	// Patron borrows the book; the chaincode lends to the caller when it is
+	// empty.
+	Patron string `json:"patron"`
+}
+
+// Loan endpoints. A book has at most one current loan, so the current loan
+// is named by the ID of its book. Patrons may borrow, renew and list only
+// their own loans; returns and losses are recorded by librarians:
+//
+//	GET  /loans                  all loan records; ?patron= lists the loans of a
+//	                             patron, ?overdue=true the overdue loans and
+//	                             ?dueBefore= the loans due before a Unix time
+//	POST /loans                  lend a book
+//	POST /loans/{bookID}/return  return a book
+//	POST /loans/{bookID}/renew   renew a loan
+//	POST /loans/{bookID}/lost    report a book on loan as lost
+func (s *Server) addLoanRoutes() {
+	s.handle(http.MethodGet, "/loans", s.listLoans)
+	s.handle(http.MethodPost, "/loans", s.borrowBook)
+	s.handle(http.MethodPost, "/loans/:bookID/return", staffOnly(s.loanAction("ReturnBook")))
+	s.handle(http.MethodPost, "/loans/:bookID/renew", s.renewBook)
+	s.handle(http.MethodPost, "/loans/:bookID/lost", staffOnly(s.loanAction("ReportLost")))
+}
+
+func (s *Server) listLoans(w http.ResponseWriter, r *http.Request, params []string) error {
+	values := r.URL.Query()
+	if values.Has("patron") {
+		patron, err := actFor(r, values.Get("patron"))
+		if err != nil {
+			return err
+		}
+		return s.query(w, r, http.StatusOK, "GetLoanHistoryByBorrower", patron)
+	}
+	if caller := callerOf(r); !caller.isStaff() {
+		return forbidden("caller is not authorized as %s: role is %s", LibrarianRole, caller.Role)
+	}
+	switch {
+	case values.Has("overdue"):
+		overdue, err := strconv.ParseBool(values.Get("overdue"))
+		if err != nil || !overdue {
+			return badRequest("overdue must be true, got %q", values.Get("overdue"))
+		}
+		return s.query(w, r, http.StatusOK, "GetOverdueLoans")
+	case values.Has("dueBefore"):
+		if _, err := strconv.ParseInt(values.Get("dueBefore"), 10, 64); err != nil {
+			return badRequest("dueBefore must be a Unix time, got %q", values.Get("dueBefore"))
+		}
+		return s.query(w, r, http.StatusOK, "GetLoansDueBefore", values.Get("dueBefore"))
+	default:
+		return s.query(w, r, http.StatusOK, "GetAllRecords")
+	}
+}
+
+func (s *Server) borrowBook(w http.ResponseWriter, r *http.Request, params []string) error {
+	var loan newLoan
+	if err := readJSON(r, &loan); err != nil {
+		return err
+	}
+	if loan.BookID == "" {
+		return badRequest("book ID must not be empty")
+	}
+	patron, err := actFor(r, loan.Patron)
+	if err != nil {
+		return err
+	}
+	if err := s.submit(r, "BorrowBook", forPatron(patron), loan.BookID); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/books/"+url.PathEscape(loan.BookID))
+	return s.query(w, r, http.StatusCreated, "ReadBook", loan.BookID)
+}
+
+// loanAction returns a handler that runs the transaction on the current loan
+// of a book and writes the book.
+func (s *Server) loanAction(name string) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params []string) error {
+		if err := s.submit(r, name, nil, params[0]); err != nil {
+			return err
+		}
+		return s.query(w, r, http.StatusOK, "ReadBook", params[0])
+	}
+}
+
+// renewBook renews a loan. The chaincode sees the server's identity, so the
+// server checks that a patron renews only a book they have on loan.
+func (s *Server) renewBook(w http.ResponseWriter, r *http.Request, params []string) error {
+	if caller := callerOf(r); !caller.isStaff() {
+		result, err := s.evaluate(r, "GetLoanHistoryByBorrower", nil, caller.Patron)
+		if err != nil {
+			return err
+		}
+		var loans []struct {
+			BookID     string `json:"bookID"`
+			ReturnTime int64  `json:"returnTime"`
+		}
+		if err := json.Unmarshal(result, &loans); err != nil {
+			return fmt.Errorf("failed to unmarshal loans: %v", err)
+		}
+		borrowed := false
+		for _, loan := range loans {
+			borrowed = borrowed || (loan.BookID == params[0] && loan.ReturnTime == 0)
+		}
+		if !borrowed {
+			return forbidden("the patron %s has not borrowed the book %s", caller.Patron, params[0])
+		}
+	}
+	return s.loanAction("RenewBook")(w, r, params)
+}
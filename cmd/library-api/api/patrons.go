@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// patronDetails is the body of POST /patrons and PUT /patrons/{id}. It is
+// passed to the chaincode as transient data, so patron details are not
+// written to the ledger. Version is the version of the patron an update is
+// based on; an update fails with 409 Conflict when the patron has changed
+// since.
+type patronDetails struct {
+	ID       string `json:"ID"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// CardExpiry is a Unix time; 0 means the card does not expire.
+	CardExpiry int64 `json:"cardExpiry"`
+	MaxLoans   int   `json:"maxLoans"`
+	// MSPID is the organization whose members may act as the patron. The
+	// chaincode uses the server's organization when it is empty.
+	MSPID   string `json:"mspID,omitempty"`
+	Version int64  `json:"version,omitempty"`
+}
+
+type payment struct {
+	Amount int64 `json:"amount"`
+}
+
+type waiver struct {
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// Patron endpoints. Patrons may only read their own record and balance;
+// everything else is done by librarians:
+//
+//	POST /patrons                 register a patron
+//	GET  /patrons/{id}            read a patron
+//	PUT  /patrons/{id}            update a patron
+//	POST /patrons/{id}/suspend    suspend a patron
+//	POST /patrons/{id}/reinstate  reinstate a suspended patron
+//	GET  /patrons/{id}/balance    fines and payments of a patron
+//	POST /patrons/{id}/payments   pay fines
+//	POST /patrons/{id}/waivers    waive fines
+func (s *Server) addPatronRoutes() {
+	s.handle(http.MethodPost, "/patrons", staffOnly(s.registerPatron))
+	s.handle(http.MethodGet, "/patrons/:id", s.patronQuery("ReadPatron"))
+	s.handle(http.MethodPut, "/patrons/:id", staffOnly(s.updatePatron))
+	s.handle(http.MethodPost, "/patrons/:id/suspend", staffOnly(s.patronAction("SuspendPatron")))
+	s.handle(http.MethodPost, "/patrons/:id/reinstate", staffOnly(s.patronAction("ReinstatePatron")))
+	s.handle(http.MethodGet, "/patrons/:id/balance", s.patronQuery("GetPatronBalance"))
+	s.handle(http.MethodPost, "/patrons/:id/payments", staffOnly(s.payFine))
+	s.handle(http.MethodPost, "/patrons/:id/waivers", staffOnly(s.waiveFine))
+}
+
+func (s *Server) registerPatron(w http.ResponseWriter, r *http.Request, params []string) error {
+	var patron patronDetails
+	if err := readJSON(r, &patron); err != nil {
+		return err
+	}
+	if err := s.submitPatronDetails(r, "RegisterPatron", &patron); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/patrons/"+url.PathEscape(patron.ID))
+	return s.query(w, r, http.StatusCreated, "ReadPatron", patron.ID)
+}
+
+func (s *Server) updatePatron(w http.ResponseWriter, r *http.Request, params []string) error {
+	var patron patronDetails
+	if err := readJSON(r, &patron); err != nil {
+		return err
+	}
+	if patron.ID == "" {
+		patron.ID = params[0]
+	} else if patron.ID != params[0] {
+		return badRequest("patron ID %s in the body does not match %s in the path", patron.ID, params[0])
+	}
+	if err := s.submitPatronDetails(r, "UpdatePatron", &patron); err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "ReadPatron", patron.ID)
+}
+
+func (s *Server) submitPatronDetails(r *http.Request, name string, patron *patronDetails) error {
+	details, err := json.Marshal(patron)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patron: %v", err)
+	}
+	return s.submit(r, name, map[string][]byte{transientPatronDetailsKey: details})
+}
+
+// patronQuery returns a handler that evaluates a query about a patron.
+func (s *Server) patronQuery(name string) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params []string) error {
+		patron, err := actFor(r, params[0])
+		if err != nil {
+			return err
+		}
+		return s.query(w, r, http.StatusOK, name, patron)
+	}
+}
+
+// patronAction returns a handler that runs the transaction for a patron and
+// writes the patron.
+func (s *Server) patronAction(name string) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params []string) error {
+		if err := s.submit(r, name, forPatron(params[0])); err != nil {
+			return err
+		}
+		return s.query(w, r, http.StatusOK, "ReadPatron", params[0])
+	}
+}
+
+func (s *Server) payFine(w http.ResponseWriter, r *http.Request, params []string) error {
+	var body payment
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	if err := s.submit(r, "PayFine", forPatron(params[0]), strconv.FormatInt(body.Amount, 10)); err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "GetPatronBalance", params[0])
+}
+
+func (s *Server) waiveFine(w http.ResponseWriter, r *http.Request, params []string) error {
+	var body waiver
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	if err := s.submit(r, "WaiveFine", forPatron(params[0]), strconv.FormatInt(body.Amount, 10), body.Reason); err != nil {
+		return err
+	}
+	return s.query(w, r, http.StatusOK, "GetPatronBalance", params[0])
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Transient data keys read by the chaincode.
+const (
+	transientPatronKey        = "patron"
+	transientPatronDetailsKey = "patronDetails"
+)
+
+// maxBodyBytes limits the size of request bodies.
+const maxBodyBytes = 1 << 20
+
+// handlerFunc handles a request to a route. params are the values of the
+// route's path parameters, in order.
+type handlerFunc func(w http.ResponseWriter, r *http.Request, params []string) error
+
+type route struct {
+	method string
+	// segments of the path; a segment starting with ":" matches any value.
+	segments []string
+	handle   handlerFunc
+}
+
+// Server is the HTTP handler of the library API.
+type Server struct {
+	backend Backend
+	tokens  map[string]Caller
+	routes  []route
+}
+
+// NewServer returns a Server that runs transactions on backend for the
+// callers named by tokens, as read by ParseTokens.
+func NewServer(backend Backend, tokens map[string]Caller) *Server {
+	s := &Server{backend: backend, tokens: tokens}
+	s.addBookRoutes()
+	s.addTitleRoutes()
+	s.addLoanRoutes()
+	s.addHoldRoutes()
+	s.addPatronRoutes()
+	return s
+}
+
+func (s *Server) handle(method string, path string, handle handlerFunc) {
+	s.routes = append(s.routes, route{method: method, segments: splitPath(path), handle: handle})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, err)
+		return
+	}
+	r = withCaller(r, caller)
+
+	segments := splitPath(r.URL.Path)
+	var allowed []string
+	for _, route := range s.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		if err := route.handle(w, r, params); err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, &requestError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method)})
+		return
+	}
+	writeError(w, &requestError{http.StatusNotFound, fmt.Sprintf("no endpoint for %s", r.URL.Path)})
+}
+
+func (r *route) match(segments []string) ([]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	var params []string
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, ":") {
+			params = append(params, segments[i])
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// requestError is an error in the request itself, found before calling the
+// chaincode.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	// Code is the code of a chaincode error.
+	Code string `json:"code,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	response := &errorResponse{Error: err.Error()}
+	var reqErr *requestError
+	var ccErr *ChaincodeError
+	if errors.As(err, &reqErr) {
+		status = reqErr.status
+	} else if errors.As(err, &ccErr) {
+		status = ccErr.StatusCode()
+		response.Code = ccErr.Code
+	} else {
+		log.Printf("backend error: %v", err)
+	}
+	writeValue(w, status, response)
+}
+
+func writeValue(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to marshal response: %v", err))
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+// writeJSON writes a JSON body, such as the payload returned by the
+// chaincode.
+func writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// readJSON decodes the request body into value.
+func readJSON(r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return badRequest("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// readRawJSON returns the request body, which must be a JSON object.
+func readRawJSON(r *http.Request) (string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+	if err != nil {
+		return "", badRequest("failed to read request body: %v", err)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return "", badRequest("request body must be a JSON object: %v", err)
+	}
+	return string(body), nil
+}
+
+func (s *Server) submit(r *http.Request, name string, transient map[string][]byte, args ...string) error {
+	_, err := s.backend.Submit(r.Context(), &Transaction{Name: name, Args: args, Transient: transient})
+	return err
+}
+
+func (s *Server) evaluate(r *http.Request, name string, transient map[string][]byte, args ...string) ([]byte, error) {
+	return s.backend.Evaluate(r.Context(), &Transaction{Name: name, Args: args, Transient: transient})
+}
+
+// query evaluates a transaction and writes its result.
+func (s *Server) query(w http.ResponseWriter, r *http.Request, status int, name string, args ...string) error {
+	result, err := s.evaluate(r, name, nil, args...)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, status, result)
+	return nil
+}
+
+func forPatron(patron string) map[string][]byte {
+	if patron == "" {
+		return nil
+	}
+	return map[string][]byte{transientPatronKey: []byte(patron)}
+}
@@ -0,0 +1,317 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/chaincode"
+	"github.com/yunlong-le/library/cmd/library-api/api"
+	"github.com/yunlong-le/library/cmd/library-api/inprocess"
+	"github.com/yunlong-le/library/memstub"
+)
+
+// Bearer tokens of the test servers.
+var tokens = map[string]api.Caller{
+	"librarian-token": {Role: api.LibrarianRole},
+	"alice-token":     {Role: api.PatronRole, Patron: "alice"},
+}
+
+// client sends requests to a test server with a bearer token and, if
+// version is set, an If-Match header.
+type client struct {
+	*httptest.Server
+	token   string
+	version string
+}
+
+// as returns a client that sends token instead.
+func (c *client) as(token string) *client {
+	return &client{Server: c.Server, token: token}
+}
+
+// ifMatch returns a client that sends version in the If-Match header.
+func (c *client) ifMatch(version int64) *client {
+	return &client{Server: c.Server, token: c.token, version: fmt.Sprintf("%q", strconv.FormatInt(version, 10))}
+}
+
+// newServer serves the chaincode in process, which sees the server as an
+// identity with role. The returned client authenticates as a librarian.
+func newServer(t *testing.T, role string) *client {
+	creator, err := memstub.Creator("Org1MSP", "librarian1", map[string]string{"role": role})
+	require.NoError(t, err)
+	cc, err := chaincode.NewChaincode(new(chaincode.SmartContract))
+	require.NoError(t, err)
+	backend, err := inprocess.New(cc, creator)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(api.NewServer(backend, tokens))
+	t.Cleanup(server.Close)
+	return &client{Server: server, token: "librarian-token"}
+}
+
+// do sends a request with body encoded as JSON, checks the status of the
+// response and decodes the response into result unless it is nil.
+func do(t *testing.T, server *client, method string, path string, body interface{}, status int, result interface{}) {
+	t.Helper()
+	var reader *bytes.Reader
+	if s, ok := body.(string); ok {
+		reader = bytes.NewReader([]byte(s))
+	} else {
+		encoded, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, server.URL+path, reader)
+	require.NoError(t, err)
+	if server.token != "" {
+		request.Header.Set("Authorization", "Bearer "+server.token)
+	}
+	if server.version != "" {
+		request.Header.Set("If-Match", server.version)
+	}
+	response, err := server.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	var decoded map[string]interface{}
+	if response.StatusCode != http.StatusNoContent {
+		require.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	}
+	if response.StatusCode != status {
+		json.NewDecoder(response.Body).Decode(&decoded)
+		require.Failf(t, "unexpected status", "%s %s: got %d, want %d: %v", method, path, response.StatusCode, status, decoded["error"])
+	}
+	if result != nil {
+		require.NoError(t, json.NewDecoder(response.Body).Decode(result))
+	}
+}
+
+type book struct {
+	ID        string `json:"ID"`
+	Name      string `json:"name"`
+	ISBN      string `json:"isbn"`
+	Available bool   `json:"available"`
+	Withdrawn bool   `json:"withdrawn"`
+	Version   int64  `json:"version"`
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func TestBooks(t *testing.T) {
+	server := newServer(t, "librarian")
+
+	var b book
+	do(t, server, "GET", "/books/B1", nil, http.StatusOK, &b)
+	require.Equal(t, "Book1", b.Name)
+	require.True(t, b.Available)
+
+	var apiErr errorBody
+	do(t, server, "GET", "/books/B9", nil, http.StatusNotFound, &apiErr)
+	require.Equal(t, "the book B9 does not exist", apiErr.Error)
+	require.Equal(t, "not_found", apiErr.Code)
+
+	newBook := map[string]string{"ID": "B6", "name": "Book6", "author": "Author6", "publisher": "p3", "isbn": "7-111-00006-4", "description": "This is book 6"}
+	do(t, server, "POST", "/books", newBook, http.StatusCreated, &b)
+	require.Equal(t, "9787111000068", b.ISBN)
+	do(t, server, "POST", "/books", newBook, http.StatusConflict, nil)
+	do(t, server, "POST", "/books", map[string]string{"ID": "B7", "isbn": "123"}, http.StatusBadRequest, nil)
+	do(t, server, "POST", "/books", map[string]string{"ID": "B7", "title": "Book7"}, http.StatusBadRequest, nil)
+
+	var books []book
+	do(t, server, "GET", "/books", nil, http.StatusOK, &books)
+	require.Len(t, books, 6)
+	do(t, server, "GET", "/books?author=Author6", nil, http.StatusOK, &books)
+	require.Len(t, books, 1)
+	do(t, server, "GET", "/books?q=Book&author=Author6", nil, http.StatusBadRequest, nil)
+
+	var page struct {
+		Books    []book `json:"books"`
+		Bookmark string `json:"bookmark"`
+	}
+	do(t, server, "GET", "/books?q=Book&pageSize=4", nil, http.StatusOK, &page)
+	require.Len(t, page.Books, 4)
+	require.NotEmpty(t, page.Bookmark)
+	do(t, server, "GET", "/books?pageSize=0", nil, http.StatusBadRequest, nil)
+
+	do(t, server, "POST", "/books/search", `{"filter":{"publisher":"p2"}}`, http.StatusOK, &books)
+	require.Len(t, books, 2)
+	do(t, server, "POST", "/books/search", `{"filter":{"colour":"red"}}`, http.StatusBadRequest, nil)
+
+	do(t, server, "PATCH", "/books/B6", `{"name":"Book6, 2nd edition"}`, http.StatusPreconditionRequired, nil)
+	do(t, server.ifMatch(b.Version), "PATCH", "/books/B6", `{"name":"Book6, 2nd edition"}`, http.StatusOK, &b)
+	require.Equal(t, "Book6, 2nd edition", b.Name)
+	do(t, server.ifMatch(b.Version), "PATCH", "/books/B6", `{"available":false}`, http.StatusBadRequest, nil)
+	do(t, server.ifMatch(b.Version-1), "PATCH", "/books/B6", `{"description":"Stale"}`, http.StatusConflict, &apiErr)
+	require.Equal(t, "version_conflict", apiErr.Code)
+
+	var history []json.RawMessage
+	do(t, server, "GET", "/books/B6/history", nil, http.StatusOK, &history)
+	require.Len(t, history, 2)
+	var patched struct {
+		TitleID string `json:"titleID"`
+	}
+	do(t, server, "GET", "/books/B6", nil, http.StatusOK, &patched)
+	do(t, server, "GET", "/titles/"+patched.TitleID+"/history", nil, http.StatusOK, &history)
+	require.Len(t, history, 1)
+	require.Contains(t, string(history[0]), "Book6, 2nd edition")
+
+	do(t, server.ifMatch(b.Version-1), "POST", "/books/B6/withdraw", map[string]string{"reason": "damaged"}, http.StatusConflict, nil)
+	do(t, server.ifMatch(b.Version), "POST", "/books/B6/withdraw", map[string]string{"reason": "damaged"}, http.StatusOK, &b)
+	require.True(t, b.Withdrawn)
+	do(t, server.ifMatch(b.Version), "POST", "/books/B6/withdraw", map[string]string{"reason": "damaged"}, http.StatusConflict, nil)
+
+	do(t, server, "GET", "/books/B1", nil, http.StatusOK, &b)
+	details := map[string]interface{}{"name": "Book1", "author": "Author1", "publisher": "p1", "isbn": b.ISBN, "description": "Revised", "available": false, "version": b.Version}
+	do(t, server, "PUT", "/books/B1", details, http.StatusOK, &b)
+	require.False(t, b.Available)
+	do(t, server, "PUT", "/books/B1", details, http.StatusConflict, nil)
+	do(t, server, "DELETE", "/books/B1", nil, http.StatusNoContent, nil)
+	do(t, server, "GET", "/books/B1", nil, http.StatusNotFound, nil)
+	do(t, server.as("alice-token"), "DELETE", "/books/B2", nil, http.StatusForbidden, nil)
+	do(t, server, "GET", "/shelves", nil, http.StatusNotFound, nil)
+}
+
+func TestLoansAndHolds(t *testing.T) {
+	server := newServer(t, "librarian")
+	for _, patron := range []string{"alice", "bob"} {
+		do(t, server, "POST", "/patrons", map[string]interface{}{"ID": patron, "name": patron, "category": "public", "maxLoans": 5}, http.StatusCreated, nil)
+	}
+
+	var b book
+	do(t, server, "POST", "/loans", map[string]string{"bookID": "B1", "patron": "alice"}, http.StatusCreated, &b)
+	require.False(t, b.Available)
+	do(t, server, "POST", "/loans", map[string]string{"bookID": "B1", "patron": "bob"}, http.StatusConflict, nil)
+	do(t, server, "POST", "/loans", map[string]string{"bookID": "B2", "patron": "zoe"}, http.StatusNotFound, nil)
+
+	var loans []json.RawMessage
+	do(t, server, "GET", "/loans?patron=alice", nil, http.StatusOK, &loans)
+	require.Len(t, loans, 1)
+	do(t, server, "GET", "/books/B1/loans", nil, http.StatusOK, &loans)
+	require.Len(t, loans, 1)
+	do(t, server, "GET", "/loans?dueBefore=soon", nil, http.StatusBadRequest, nil)
+
+	var holds []struct {
+		Patron string `json:"patron"`
+	}
+	do(t, server, "POST", "/books/B1/holds", map[string]string{"patron": "bob"}, http.StatusCreated, &holds)
+	require.Len(t, holds, 1)
+	require.Equal(t, "bob", holds[0].Patron)
+	do(t, server, "GET", "/books/B1", nil, http.StatusOK, &b)
+	do(t, server.ifMatch(b.Version), "POST", "/books/B1/withdraw", map[string]string{"reason": "damaged"}, http.StatusConflict, nil)
+	do(t, server, "DELETE", "/books/B1", nil, http.StatusConflict, nil)
+	do(t, server, "DELETE", "/books/B1/holds/bob", nil, http.StatusNoContent, nil)
+	do(t, server, "DELETE", "/books/B1/holds/bob", nil, http.StatusConflict, nil)
+	do(t, server, "POST", "/books/B1/expire-hold", nil, http.StatusConflict, nil)
+	do(t, server, "GET", "/books/B1/holds", nil, http.StatusOK, &holds)
+	require.Empty(t, holds)
+
+	do(t, server, "POST", "/loans/B1/renew", nil, http.StatusOK, &b)
+	do(t, server, "POST", "/loans/B1/return", nil, http.StatusOK, &b)
+	require.True(t, b.Available)
+	do(t, server, "POST", "/loans/B1/return", nil, http.StatusConflict, nil)
+}
+
+func TestPatrons(t *testing.T) {
+	server := newServer(t, "librarian")
+
+	var patron struct {
+		ID       string `json:"ID"`
+		Name     string `json:"name"`
+		Status   string `json:"status"`
+		MaxLoans int    `json:"maxLoans"`
+		Version  int64  `json:"version"`
+	}
+	do(t, server, "POST", "/patrons", map[string]interface{}{"ID": "alice", "name": "Alice", "category": "public", "maxLoans": 2}, http.StatusCreated, &patron)
+	require.Equal(t, "Alice", patron.Name)
+	do(t, server, "POST", "/patrons", map[string]interface{}{"ID": "alice", "name": "Alice", "category": "public", "maxLoans": 2}, http.StatusConflict, nil)
+	update := map[string]interface{}{"name": "Alice A.", "category": "public", "maxLoans": 3, "version": patron.Version}
+	do(t, server, "PUT", "/patrons/alice", update, http.StatusOK, &patron)
+	require.Equal(t, "Alice A.", patron.Name)
+	require.Equal(t, 3, patron.MaxLoans)
+	do(t, server, "PUT", "/patrons/alice", update, http.StatusConflict, nil)
+	do(t, server, "PUT", "/patrons/alice", map[string]interface{}{"ID": "bob", "maxLoans": 3}, http.StatusBadRequest, nil)
+	do(t, server, "GET", "/patrons/bob", nil, http.StatusNotFound, nil)
+
+	do(t, server, "POST", "/patrons/alice/suspend", nil, http.StatusOK, &patron)
+	require.Equal(t, "suspended", patron.Status)
+	do(t, server, "POST", "/loans", map[string]string{"bookID": "B1", "patron": "alice"}, http.StatusConflict, nil)
+	do(t, server, "POST", "/patrons/alice/reinstate", nil, http.StatusOK, &patron)
+	require.Equal(t, "active", patron.Status)
+
+	var balance struct {
+		Balance int64 `json:"balance"`
+	}
+	do(t, server, "GET", "/patrons/alice/balance", nil, http.StatusOK, &balance)
+	require.Zero(t, balance.Balance)
+	do(t, server, "POST", "/patrons/alice/payments", map[string]int64{"amount": 100}, http.StatusConflict, nil)
+	do(t, server, "POST", "/patrons/alice/waivers", map[string]interface{}{"amount": -1, "reason": "goodwill"}, http.StatusBadRequest, nil)
+}
+
+func TestForbidden(t *testing.T) {
+	server := newServer(t, "patron")
+
+	do(t, server, "GET", "/books/B1", nil, http.StatusOK, nil)
+	do(t, server, "POST", "/books", map[string]string{"ID": "B6", "name": "Book6", "isbn": "9787111000068"}, http.StatusForbidden, nil)
+	do(t, server.ifMatch(1), "POST", "/books/B1/withdraw", map[string]string{"reason": "damaged"}, http.StatusForbidden, nil)
+}
+
+func TestAuthentication(t *testing.T) {
+	server := newServer(t, "librarian")
+	for _, patron := range []string{"alice", "bob"} {
+		do(t, server, "POST", "/patrons", map[string]interface{}{"ID": patron, "name": patron, "category": "public", "maxLoans": 5}, http.StatusCreated, nil)
+	}
+	do(t, server, "POST", "/loans", map[string]string{"bookID": "B2", "patron": "bob"}, http.StatusCreated, nil)
+
+	var apiErr errorBody
+	do(t, server.as(""), "GET", "/books/B1", nil, http.StatusUnauthorized, &apiErr)
+	require.Equal(t, "the request has no bearer token", apiErr.Error)
+	do(t, server.as("mallory-token"), "GET", "/books/B1", nil, http.StatusUnauthorized, nil)
+
+	alice := server.as("alice-token")
+	do(t, alice, "GET", "/books/B1", nil, http.StatusOK, nil)
+	do(t, alice, "POST", "/books", map[string]string{"ID": "B6", "name": "Book6", "isbn": "9787111000068"}, http.StatusForbidden, &apiErr)
+	require.Equal(t, "caller is not authorized as librarian: role is patron", apiErr.Error)
+	do(t, alice, "POST", "/loans", map[string]string{"bookID": "B1", "patron": "bob"}, http.StatusForbidden, &apiErr)
+	require.Equal(t, "cannot act for bob: caller is the patron alice", apiErr.Error)
+	do(t, alice, "POST", "/loans", map[string]string{"bookID": "B1"}, http.StatusCreated, nil)
+	do(t, alice, "POST", "/loans/B1/renew", nil, http.StatusOK, nil)
+	do(t, alice, "POST", "/loans/B2/renew", nil, http.StatusForbidden, &apiErr)
+	require.Equal(t, "the patron alice has not borrowed the book B2", apiErr.Error)
+	do(t, alice, "POST", "/loans/B1/return", nil, http.StatusForbidden, nil)
+
+	var loans []json.RawMessage
+	do(t, alice, "GET", "/loans?patron=alice", nil, http.StatusOK, &loans)
+	require.Len(t, loans, 1)
+	do(t, alice, "GET", "/loans?patron=bob", nil, http.StatusForbidden, nil)
+	do(t, alice, "GET", "/loans", nil, http.StatusForbidden, nil)
+
+	do(t, alice, "POST", "/books/B2/holds", map[string]string{}, http.StatusNoContent, nil)
+	do(t, alice, "GET", "/books/B2/holds", nil, http.StatusForbidden, nil)
+	do(t, alice, "DELETE", "/books/B2/holds/bob", nil, http.StatusForbidden, nil)
+	do(t, alice, "DELETE", "/books/B2/holds/alice", nil, http.StatusNoContent, nil)
+
+	do(t, alice, "GET", "/patrons/alice", nil, http.StatusOK, nil)
+	do(t, alice, "GET", "/patrons/bob", nil, http.StatusForbidden, nil)
+	do(t, alice, "GET", "/patrons/bob/balance", nil, http.StatusForbidden, nil)
+	do(t, alice, "POST", "/patrons/alice/payments", map[string]int64{"amount": 100}, http.StatusForbidden, nil)
+}
+
+func TestParseTokens(t *testing.T) {
+	parsed, err := api.ParseTokens([]byte(`{"t1": {"role": "librarian"}, "t2": {"role": "patron", "patron": "alice"}}`))
+	require.NoError(t, err)
+	require.Equal(t, api.Caller{Role: api.PatronRole, Patron: "alice"}, parsed["t2"])
+
+	_, err = api.ParseTokens([]byte(`{"t1": {"role": "admin"}}`))
+	require.EqualError(t, err, `role must be librarian or patron, got "admin"`)
+	_, err = api.ParseTokens([]byte(`{"t1": {"role": "patron"}}`))
+	require.EqualError(t, err, "a patron token must name a patron")
+}
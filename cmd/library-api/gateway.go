@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/yunlong-le/library/cmd/library-api/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// GatewayConfig says how to reach a peer through the Fabric Gateway.
+type GatewayConfig struct {
+	// Endpoint is the address of the peer, such as localhost:7051.
+	Endpoint string
+	// ServerName overrides the host name checked against the peer's TLS
+	// certificate, such as peer0.org1.example.com.
+	ServerName string
+	// TLSCertPath is the PEM file of the CA that signed the peer's TLS
+	// certificate.
+	TLSCertPath string
+	// CertPath and KeyPath are the PEM files of the identity the API calls
+	// the chaincode as. It should have the librarian role.
+	CertPath string
+	KeyPath  string
+	MSPID    string
+	Channel  string
+	// Chaincode is the name the library chaincode is deployed under.
+	Chaincode string
+}
+
+// GatewayBackend is an api.Backend that runs transactions on a Fabric
+// network through the Fabric Gateway.
+type GatewayBackend struct {
+	contract *client.Contract
+	close    func()
+}
+
+// DialGateway connects to the peer described by config.
+func DialGateway(config GatewayConfig) (*GatewayBackend, error) {
+	tlsCertPEM, err := os.ReadFile(config.TLSCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	tlsCert, err := identity.CertificateFromPEM(tlsCertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS certificate: %v", err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(tlsCert)
+	transportCredentials := credentials.NewClientTLSFromCert(certPool, config.ServerName)
+	connection, err := grpc.Dial(config.Endpoint, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", config.Endpoint, err)
+	}
+
+	id, sign, err := loadIdentity(config)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	gw, err := client.Connect(id, client.WithSign(sign), client.WithClientConnection(connection))
+	if err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("failed to connect to gateway: %v", err)
+	}
+
+	return &GatewayBackend{
+		contract: gw.GetNetwork(config.Channel).GetContract(config.Chaincode),
+		close: func() {
+			gw.Close()
+			connection.Close()
+		},
+	}, nil
+}
+
+func loadIdentity(config GatewayConfig) (*identity.X509Identity, identity.Sign, error) {
+	certPEM, err := os.ReadFile(config.CertPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client certificate: %v", err)
+	}
+	cert, err := identity.CertificateFromPEM(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse client certificate: %v", err)
+	}
+	id, err := identity.NewX509Identity(config.MSPID, cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(config.KeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	key, err := identity.PrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	sign, err := identity.NewPrivateKeySign(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, sign, nil
+}
+
+// Submit implements api.Backend. It returns once the transaction is
+// committed.
+func (b *GatewayBackend) Submit(ctx context.Context, tx *api.Transaction) ([]byte, error) {
+	proposal, err := b.proposal(tx)
+	if err != nil {
+		return nil, err
+	}
+	transaction, err := proposal.EndorseWithContext(ctx)
+	if err != nil {
+		return nil, chaincodeError(err)
+	}
+	commit, err := transaction.SubmitWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	commitStatus, err := commit.StatusWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !commitStatus.Successful {
+		return nil, fmt.Errorf("transaction %s failed to commit with status %s", commitStatus.TransactionID, commitStatus.Code)
+	}
+	return transaction.Result(), nil
+}
+
+// Evaluate implements api.Backend.
+func (b *GatewayBackend) Evaluate(ctx context.Context, tx *api.Transaction) ([]byte, error) {
+	proposal, err := b.proposal(tx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := proposal.EvaluateWithContext(ctx)
+	if err != nil {
+		return nil, chaincodeError(err)
+	}
+	return result, nil
+}
+
+func (b *GatewayBackend) proposal(tx *api.Transaction) (*client.Proposal, error) {
+	options := []client.ProposalOption{client.WithArguments(tx.Args...)}
+	if len(tx.Transient) > 0 {
+		options = append(options, client.WithTransient(tx.Transient))
+	}
+	proposal, err := b.contract.NewProposal(tx.Name, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proposal for %s: %v", tx.Name, err)
+	}
+	return proposal, nil
+}
+
+// Close disconnects from the peer.
+func (b *GatewayBackend) Close() {
+	b.close()
+}
+
+// chaincodeErrorPrefix starts the message of a peer whose chaincode returned
+// an error response.
+const chaincodeErrorPrefix = "chaincode response 500, "
+
+// chaincodeError returns the error of the chaincode if err reports one from
+// any of the endorsing peers, and err otherwise.
+func chaincodeError(err error) error {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return err
+	}
+	for _, detail := range grpcErr.GRPCStatus().Details() {
+		errorDetail, ok := detail.(*gateway.ErrorDetail)
+		if ok && strings.HasPrefix(errorDetail.Message, chaincodeErrorPrefix) {
+			return api.NewChaincodeError(strings.TrimPrefix(errorDetail.Message, chaincodeErrorPrefix))
+		}
+	}
+	return err
+}
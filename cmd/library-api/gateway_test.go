@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/cmd/library-api/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestChaincodeError(t *testing.T) {
+	endorseStatus, err := status.New(codes.Aborted, "failed to endorse transaction").WithDetails(
+		&gateway.ErrorDetail{Address: "peer0.org1.example.com:7051", MspId: "Org1MSP", Message: `chaincode response 500, {"code":"not_found","message":"the book B9 does not exist"}`},
+	)
+	require.NoError(t, err)
+
+	err = chaincodeError(fmt.Errorf("evaluate: %w", endorseStatus.Err()))
+	var ccErr *api.ChaincodeError
+	require.ErrorAs(t, err, &ccErr)
+	require.Equal(t, "the book B9 does not exist", ccErr.Message)
+	require.Equal(t, http.StatusNotFound, ccErr.StatusCode())
+
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	require.Equal(t, unavailable, chaincodeError(unavailable))
+}
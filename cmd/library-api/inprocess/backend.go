@@ -0,0 +1,71 @@
+// Package inprocess runs the library chaincode in the same process as the
+// API server, against an in-memory ledger. It is meant for tests and local
+// development: the ledger is lost when the process exits.
+//
+// The package links the chaincode shim, whose protobuf definitions clash
+// with those of the Fabric Gateway client, so it cannot be linked into the
+// library-api command itself.
+package inprocess
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/yunlong-le/library/cmd/library-api/api"
+	"github.com/yunlong-le/library/memstub"
+)
+
+// Backend is an api.Backend that invokes a chaincode directly. Transactions
+// run one at a time; a transaction the chaincode rejects and every evaluated
+// transaction leave the ledger unchanged.
+type Backend struct {
+	mu   sync.Mutex
+	cc   shim.Chaincode
+	stub *memstub.Stub
+}
+
+// New initializes cc on an empty ledger. Transactions are invoked by the
+// identity creator, a serialized msp.SerializedIdentity such as the one
+// returned by memstub.Creator.
+func New(cc shim.Chaincode, creator []byte) (*Backend, error) {
+	stub := memstub.New("library")
+	stub.Creator = creator
+	response := stub.Init(cc)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return nil, fmt.Errorf("failed to initialize chaincode: %s", response.Message)
+	}
+	return &Backend{cc: cc, stub: stub}, nil
+}
+
+// Submit implements api.Backend.
+func (b *Backend) Submit(ctx context.Context, tx *api.Transaction) ([]byte, error) {
+	return b.invoke(ctx, tx, true)
+}
+
+// Evaluate implements api.Backend.
+func (b *Backend) Evaluate(ctx context.Context, tx *api.Transaction) ([]byte, error) {
+	return b.invoke(ctx, tx, false)
+}
+
+func (b *Backend) invoke(ctx context.Context, tx *api.Transaction, commit bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stub.BeginWithTransient(tx.Transient, append([]string{tx.Name}, tx.Args...)...)
+	response := b.cc.Invoke(b.stub)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		b.stub.Rollback()
+		return nil, api.NewChaincodeError(response.Message)
+	}
+	if commit {
+		b.stub.Commit()
+	} else {
+		b.stub.Rollback()
+	}
+	return response.Payload, nil
+}
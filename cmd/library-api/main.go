@@ -0,0 +1,81 @@
+// Command library-api serves the library chaincode as a JSON HTTP API for
+// clients that do not use a Fabric SDK. The endpoints are described in
+// package api.
+//
+// The API calls the chaincode through the Fabric Gateway as a single
+// identity, which should have the librarian role, and authenticates its own
+// callers with the bearer tokens in the -tokens file (see api.ParseTokens):
+//
+//	library-api -listen localhost:8080 -tokens tokens.json -peer localhost:7051 \
+//		-server-name peer0.org1.example.com -tls-cert ca.crt -cert cert.pem -key key.pem -msp-id Org1MSP
+//
+// The API serves plain HTTP, so it listens on localhost unless told
+// otherwise; put it behind a TLS-terminating proxy before exposing it.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yunlong-le/library/cmd/library-api/api"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:8080", "address to serve HTTP on")
+	tokensPath := flag.String("tokens", "", "JSON file mapping bearer tokens to callers")
+	var gateway GatewayConfig
+	flag.StringVar(&gateway.Endpoint, "peer", "localhost:7051", "peer endpoint")
+	flag.StringVar(&gateway.ServerName, "server-name", "peer0.org1.example.com", "host name in the peer's TLS certificate")
+	flag.StringVar(&gateway.TLSCertPath, "tls-cert", "", "PEM file of the peer's TLS CA certificate")
+	flag.StringVar(&gateway.CertPath, "cert", "", "PEM file of the client certificate")
+	flag.StringVar(&gateway.KeyPath, "key", "", "PEM file of the client private key")
+	flag.StringVar(&gateway.MSPID, "msp-id", "Org1MSP", "MSP ID of the client")
+	flag.StringVar(&gateway.Channel, "channel", "mychannel", "channel name")
+	flag.StringVar(&gateway.Chaincode, "chaincode", "library", "chaincode name")
+	flag.Parse()
+
+	if *tokensPath == "" {
+		log.Fatal("-tokens is required")
+	}
+	data, err := os.ReadFile(*tokensPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens, err := api.ParseTokens(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backend, err := DialGateway(gateway)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer backend.Close()
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           api.NewServer(backend, tokens),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("serving the library API on %s", *listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
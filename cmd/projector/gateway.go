@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// GatewayConfig says how to reach a peer through the Fabric Gateway.
+type GatewayConfig struct {
+	// Endpoint is the address of the peer, such as localhost:7051.
+	Endpoint string
+	// ServerName overrides the host name checked against the peer's TLS
+	// certificate, such as peer0.org1.example.com.
+	ServerName string
+	// TLSCertPath is the PEM file of the CA that signed the peer's TLS
+	// certificate.
+	TLSCertPath string
+	// CertPath and KeyPath are the PEM files of the client identity.
+	CertPath string
+	KeyPath  string
+	MSPID    string
+	Channel  string
+	// Chaincode is the name the library chaincode is deployed under.
+	Chaincode string
+}
+
+// GatewaySource reads chaincode events from a peer.
+type GatewaySource struct {
+	network   *client.Network
+	chaincode string
+	close     func()
+}
+
+// DialGateway connects to the peer described by config.
+func DialGateway(config GatewayConfig) (*GatewaySource, error) {
+	tlsCertPEM, err := os.ReadFile(config.TLSCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	tlsCert, err := identity.CertificateFromPEM(tlsCertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS certificate: %v", err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(tlsCert)
+	transportCredentials := credentials.NewClientTLSFromCert(certPool, config.ServerName)
+	connection, err := grpc.Dial(config.Endpoint, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", config.Endpoint, err)
+	}
+
+	id, sign, err := loadIdentity(config)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	gateway, err := client.Connect(id, client.WithSign(sign), client.WithClientConnection(connection))
+	if err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("failed to connect to gateway: %v", err)
+	}
+
+	return &GatewaySource{
+		network:   gateway.GetNetwork(config.Channel),
+		chaincode: config.Chaincode,
+		close: func() {
+			gateway.Close()
+			connection.Close()
+		},
+	}, nil
+}
+
+func loadIdentity(config GatewayConfig) (*identity.X509Identity, identity.Sign, error) {
+	certPEM, err := os.ReadFile(config.CertPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client certificate: %v", err)
+	}
+	cert, err := identity.CertificateFromPEM(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse client certificate: %v", err)
+	}
+	id, err := identity.NewX509Identity(config.MSPID, cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(config.KeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	key, err := identity.PrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	sign, err := identity.NewPrivateKeySign(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, sign, nil
+}
+
+// Run implements Source. It keeps waiting for new events until ctx is done.
+func (s *GatewaySource) Run(ctx context.Context, start uint64, handle func(*Event) error) error {
+	// Cancel the event stream when handle fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chaincodeEvents, err := s.network.ChaincodeEvents(ctx, s.chaincode, client.WithStartBlock(start))
+	if err != nil {
+		return fmt.Errorf("failed to read chaincode events: %v", err)
+	}
+	for chaincodeEvent := range chaincodeEvents {
+		event := &Event{
+			BlockNumber: chaincodeEvent.BlockNumber,
+			TxID:        chaincodeEvent.TransactionID,
+			Name:        chaincodeEvent.EventName,
+			Payload:     chaincodeEvent.Payload,
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Close disconnects from the peer.
+func (s *GatewaySource) Close() {
+	s.close()
+}
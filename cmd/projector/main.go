@@ -0,0 +1,92 @@
+// Command projector keeps an SQLite read model of the library up to date
+// from the chaincode events emitted by the library chaincode, so reports can
+// be run without querying the peers.
+//
+// The database holds the books, their loans, the patrons and fine
+// settlements. Chaincode events never identify patrons: the patrons table is
+// keyed by the opaque reference their events carry and holds no names, and
+// loans are not linked to their borrowers.
+//
+// Every applied event is recorded with its block number and transaction ID.
+// On restart the projector resumes from the last block it applied and skips
+// the transactions it has seen, so replaying events is harmless.
+//
+// Events are read from a peer through the Fabric Gateway:
+//
+//	projector -db library.db -peer localhost:7051 -server-name peer0.org1.example.com \
+//		-tls-cert ca.crt -cert cert.pem -key key.pem -msp-id Org1MSP
+//
+// or from a file with one JSON event per line, for tests and replays:
+//
+//	projector -db library.db -events events.jsonl
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	dbPath := flag.String("db", "library.db", "SQLite database file")
+	eventsPath := flag.String("events", "", "read events from this file instead of a peer")
+	var gateway GatewayConfig
+	flag.StringVar(&gateway.Endpoint, "peer", "localhost:7051", "peer endpoint")
+	flag.StringVar(&gateway.ServerName, "server-name", "peer0.org1.example.com", "host name in the peer's TLS certificate")
+	flag.StringVar(&gateway.TLSCertPath, "tls-cert", "", "PEM file of the peer's TLS CA certificate")
+	flag.StringVar(&gateway.CertPath, "cert", "", "PEM file of the client certificate")
+	flag.StringVar(&gateway.KeyPath, "key", "", "PEM file of the client private key")
+	flag.StringVar(&gateway.MSPID, "msp-id", "Org1MSP", "MSP ID of the client")
+	flag.StringVar(&gateway.Channel, "channel", "mychannel", "channel name")
+	flag.StringVar(&gateway.Chaincode, "chaincode", "library", "chaincode name")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, err := OpenStore(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	var source Source
+	if *eventsPath != "" {
+		source = &FileSource{Path: *eventsPath}
+	} else {
+		gatewaySource, err := DialGateway(gateway)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer gatewaySource.Close()
+		source = gatewaySource
+	}
+
+	if err := Project(ctx, source, store); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+// Project applies the events of source to store, starting from the store's
+// checkpoint.
+func Project(ctx context.Context, source Source, store *Store) error {
+	start, err := store.Checkpoint()
+	if err != nil {
+		return err
+	}
+	log.Printf("reading events from block %d", start)
+
+	return source.Run(ctx, start, func(event *Event) error {
+		applied, err := store.Apply(event)
+		if err != nil {
+			return err
+		}
+		if applied {
+			log.Printf("applied %s of transaction %s in block %d", event.Name, event.TxID, event.BlockNumber)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectFileEvents(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	source := &FileSource{Path: "testdata/events.jsonl"}
+	require.NoError(t, Project(context.Background(), source, store))
+	checkpoint, err := store.Checkpoint()
+	require.NoError(t, err)
+	require.EqualValues(t, 11, checkpoint)
+
+	var available, held bool
+	var loanID string
+	row := store.DB().QueryRow(`SELECT available, held, loan_id FROM books WHERE id = 'B6'`)
+	require.NoError(t, row.Scan(&available, &held, &loanID))
+	// B6 passed from a hold whose pickup window lapsed to one that was
+	// cancelled.
+	require.True(t, available)
+	require.False(t, held)
+	require.Empty(t, loanID)
+
+	var dueTime, renewals, returnTime, fine int64
+	row = store.DB().QueryRow(`SELECT due_time, renewals, return_time, fine FROM loans WHERE loan_id = 'tx3'`)
+	require.NoError(t, row.Scan(&dueTime, &renewals, &returnTime, &fine))
+	require.Equal(t, []int64{3000, 1, 3500, 50}, []int64{dueTime, renewals, returnTime, fine})
+
+	var name, reason string
+	var withdrawn bool
+	row = store.DB().QueryRow(`SELECT name, withdrawn, withdrawn_reason FROM books WHERE id = 'B7'`)
+	require.NoError(t, row.Scan(&name, &withdrawn, &reason))
+	require.Equal(t, "Book7", name)
+	require.True(t, withdrawn)
+	require.Equal(t, "damaged", reason)
+
+	var paid int64
+	require.NoError(t, store.DB().QueryRow(`SELECT SUM(amount) FROM fine_settlements`).Scan(&paid))
+	require.EqualValues(t, 50, paid)
+
+	var status string
+	var maxLoans, cardExpiry int64
+	row = store.DB().QueryRow(`SELECT status, max_loans, card_expiry FROM patrons WHERE ref = 'tx10'`)
+	require.NoError(t, row.Scan(&status, &maxLoans, &cardExpiry))
+	require.Equal(t, "active", status)
+	require.Equal(t, []int64{5, 9000}, []int64{maxLoans, cardExpiry})
+	// A patron registered before patron events existed appears on its first
+	// change.
+	require.NoError(t, store.DB().QueryRow(`SELECT status FROM patrons WHERE ref = 'tx0'`).Scan(&status))
+	require.Equal(t, "suspended", status)
+
+	// Replaying the whole file changes nothing.
+	applied, err := store.Apply(&Event{BlockNumber: 6, TxID: "tx3", Name: "BookBorrowed", Payload: []byte(`{"version":1,"bookID":"B6","loanID":"tx3","lendingTime":1000,"dueTime":2000}`)})
+	require.NoError(t, err)
+	require.False(t, applied)
+	require.NoError(t, source.Run(context.Background(), 0, func(event *Event) error {
+		applied, err := store.Apply(event)
+		require.False(t, applied, event.TxID)
+		return err
+	}))
+	var loans int
+	require.NoError(t, store.DB().QueryRow(`SELECT COUNT(*) FROM loans`).Scan(&loans))
+	require.Equal(t, 1, loans)
+}
+
+func TestProjectRejectsUnknownEvents(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.Apply(&Event{BlockNumber: 1, TxID: "tx1", Name: "BookStolen", Payload: []byte(`{"version":1}`)})
+	require.EqualError(t, err, `transaction tx1: unknown event "BookStolen"`)
+	_, err = store.Apply(&Event{BlockNumber: 1, TxID: "tx1", Name: "BookCreated", Payload: []byte(`{"version":2}`)})
+	require.EqualError(t, err, "transaction tx1: unsupported version 2 of event BookCreated")
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("\nnot json\n"), 0o600))
+	err = Project(context.Background(), &FileSource{Path: path}, store)
+	require.EqualError(t, err, "failed to parse "+path+" line 2: invalid character 'o' in literal null (expecting 'u')")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Event is a chaincode event together with the transaction that emitted it.
+type Event struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	TxID        string `json:"txID"`
+	Name        string `json:"eventName"`
+	// Payload is the JSON payload of the event, see package events.
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Source delivers the chaincode events of the library in ledger order.
+type Source interface {
+	// Run passes every event from block start onwards to handle, stopping at
+	// the first error handle returns. Events of block start that were seen
+	// before may be delivered again.
+	Run(ctx context.Context, start uint64, handle func(*Event) error) error
+}
+
+// FileSource reads events from a file with one JSON encoded Event per line,
+// such as a capture of the events of a network. It stops at the end of the
+// file.
+type FileSource struct {
+	Path string
+}
+
+// Run implements Source.
+func (s *FileSource) Run(ctx context.Context, start uint64, handle func(*Event) error) error {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open event file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("failed to parse %s line %d: %v", s.Path, line, err)
+		}
+		if event.BlockNumber < start {
+			continue
+		}
+		if err := handle(&event); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read event file: %v", err)
+	}
+	return nil
+}
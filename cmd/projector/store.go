@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yunlong-le/library/events"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS books (
+	id               TEXT PRIMARY KEY,
+	title_id         TEXT NOT NULL,
+	name             TEXT NOT NULL,
+	author           TEXT NOT NULL,
+	isbn             TEXT NOT NULL,
+	publisher        TEXT NOT NULL,
+	available        INTEGER NOT NULL,
+	held             INTEGER NOT NULL DEFAULT 0,
+	lost             INTEGER NOT NULL DEFAULT 0,
+	withdrawn        INTEGER NOT NULL DEFAULT 0,
+	withdrawn_reason TEXT NOT NULL DEFAULT '',
+	withdrawn_time   INTEGER NOT NULL DEFAULT 0,
+	loan_id          TEXT NOT NULL DEFAULT '',
+	due_time         INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS loans (
+	loan_id      TEXT PRIMARY KEY,
+	book_id      TEXT NOT NULL,
+	lending_time INTEGER NOT NULL,
+	due_time     INTEGER NOT NULL,
+	renewals     INTEGER NOT NULL DEFAULT 0,
+	return_time  INTEGER NOT NULL DEFAULT 0,
+	fine         INTEGER NOT NULL DEFAULT 0,
+	lost         INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS loans_book_id ON loans (book_id);
+CREATE TABLE IF NOT EXISTS fine_settlements (
+	entry_id TEXT PRIMARY KEY,
+	type     TEXT NOT NULL,
+	amount   INTEGER NOT NULL,
+	reason   TEXT NOT NULL DEFAULT '',
+	time     INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS patrons (
+	ref         TEXT PRIMARY KEY,
+	category    TEXT NOT NULL DEFAULT '',
+	status      TEXT NOT NULL DEFAULT 'active',
+	max_loans   INTEGER NOT NULL DEFAULT 0,
+	card_expiry INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS applied_events (
+	block_number INTEGER NOT NULL,
+	tx_id        TEXT NOT NULL,
+	event_name   TEXT NOT NULL,
+	PRIMARY KEY (block_number, tx_id)
+);
+`
+
+// Store is the SQLite read model.
+type Store struct {
+	db *sql.DB
+}
+
+// OpenStore opens the SQLite database at path, creating the tables that do
+// not exist yet.
+func OpenStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %v", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// DB returns the database for reporting queries.
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// Checkpoint returns the block to resume from: the last block with an
+// applied event. Events of that block that were applied already are skipped
+// by Apply.
+func (s *Store) Checkpoint() (uint64, error) {
+	var block uint64
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(block_number), 0) FROM applied_events`).Scan(&block)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	return block, nil
+}
+
+// Apply updates the read model with event in one database transaction. It
+// returns false when the event was applied before.
+func (s *Store) Apply(event *Event) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var seen int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM applied_events WHERE block_number = ? AND tx_id = ?`, event.BlockNumber, event.TxID).Scan(&seen)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up transaction %s: %v", event.TxID, err)
+	}
+	if seen > 0 {
+		return false, nil
+	}
+
+	payload, err := events.Decode(event.Name, event.Payload)
+	if err != nil {
+		return false, fmt.Errorf("transaction %s: %v", event.TxID, err)
+	}
+	if err := project(tx, payload); err != nil {
+		return false, fmt.Errorf("failed to apply %s of transaction %s: %v", event.Name, event.TxID, err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO applied_events (block_number, tx_id, event_name) VALUES (?, ?, ?)`, event.BlockNumber, event.TxID, event.Name)
+	if err != nil {
+		return false, fmt.Errorf("failed to record transaction %s: %v", event.TxID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction %s: %v", event.TxID, err)
+	}
+	return true, nil
+}
+
+// project writes the changes described by event. Hold events only affect
+// the books through the Held flag of BookReturned and the state HoldExpired
+// and HoldCancelled carry: holds fulfilled by a loan emit no event of their
+// own, so a hold table could not be kept accurate.
+// Patrons registered before patron events existed first appear with the
+// event of a later change, so patron events insert the patron when needed.
+func project(tx *sql.Tx, event events.Event) error {
+	var err error
+	switch e := event.(type) {
+	case *events.BookCreated:
+		_, err = tx.Exec(`INSERT INTO books (id, title_id, name, author, isbn, publisher, available) VALUES (?, ?, ?, ?, ?, ?, 1)`,
+			e.BookID, e.TitleID, e.Name, e.Author, e.ISBN, e.Publisher)
+	case *events.BookUpdated:
+		_, err = tx.Exec(`UPDATE books SET title_id = ?, name = ?, author = ?, isbn = ?, publisher = ?, available = ? WHERE id = ?`,
+			e.TitleID, e.Name, e.Author, e.ISBN, e.Publisher, e.Available, e.BookID)
+	case *events.BookDeleted:
+		_, err = tx.Exec(`DELETE FROM books WHERE id = ?`, e.BookID)
+	case *events.BookWithdrawn:
+		_, err = tx.Exec(`UPDATE books SET available = 0, withdrawn = 1, withdrawn_reason = ?, withdrawn_time = ? WHERE id = ?`,
+			e.Reason, e.WithdrawnTime, e.BookID)
+	case *events.BookBorrowed:
+		_, err = tx.Exec(`UPDATE books SET available = 0, held = 0, loan_id = ?, due_time = ? WHERE id = ?`,
+			e.LoanID, e.DueTime, e.BookID)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO loans (loan_id, book_id, lending_time, due_time) VALUES (?, ?, ?, ?)`,
+				e.LoanID, e.BookID, e.LendingTime, e.DueTime)
+		}
+	case *events.BookRenewed:
+		_, err = tx.Exec(`UPDATE books SET due_time = ? WHERE id = ?`, e.DueTime, e.BookID)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE loans SET due_time = ?, renewals = ? WHERE loan_id = ?`, e.DueTime, e.Renewals, e.LoanID)
+		}
+	case *events.BookReturned:
+		_, err = tx.Exec(`UPDATE books SET available = ?, held = ?, loan_id = '', due_time = 0 WHERE id = ?`,
+			!e.Held, e.Held, e.BookID)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE loans SET return_time = ?, fine = ? WHERE loan_id = ?`, e.ReturnTime, e.Fine, e.LoanID)
+		}
+	case *events.BookLost:
+		_, err = tx.Exec(`UPDATE books SET available = 0, held = 0, lost = 1, loan_id = '', due_time = 0 WHERE id = ?`, e.BookID)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE loans SET return_time = ?, fine = ?, lost = 1 WHERE loan_id = ?`, e.ReportTime, e.Fine, e.LoanID)
+		}
+	case *events.HoldExpired:
+		_, err = tx.Exec(`UPDATE books SET available = ?, held = ? WHERE id = ?`, e.Available, e.Held, e.BookID)
+	case *events.HoldCancelled:
+		_, err = tx.Exec(`UPDATE books SET available = ?, held = ? WHERE id = ?`, e.Available, e.Held, e.BookID)
+	case *events.FinePaid:
+		_, err = tx.Exec(`INSERT INTO fine_settlements (entry_id, type, amount, time) VALUES (?, 'payment', ?, ?)`,
+			e.EntryID, e.Amount, e.Time)
+	case *events.FineWaived:
+		_, err = tx.Exec(`INSERT INTO fine_settlements (entry_id, type, amount, reason, time) VALUES (?, 'waiver', ?, ?, ?)`,
+			e.EntryID, e.Amount, e.Reason, e.Time)
+	case *events.PatronRegistered:
+		err = upsertPatron(tx, e.PatronRef, e.Category, e.MaxLoans, e.CardExpiry)
+	case *events.PatronUpdated:
+		err = upsertPatron(tx, e.PatronRef, e.Category, e.MaxLoans, e.CardExpiry)
+	case *events.PatronSuspended:
+		err = setPatronStatus(tx, e.PatronRef, "suspended")
+	case *events.PatronReinstated:
+		err = setPatronStatus(tx, e.PatronRef, "active")
+	}
+	return err
+}
+
+func upsertPatron(tx *sql.Tx, ref string, category string, maxLoans int, cardExpiry int64) error {
+	_, err := tx.Exec(`INSERT INTO patrons (ref, category, max_loans, card_expiry) VALUES (?, ?, ?, ?)
+		ON CONFLICT (ref) DO UPDATE SET category = excluded.category, max_loans = excluded.max_loans, card_expiry = excluded.card_expiry`,
+		ref, category, maxLoans, cardExpiry)
+	return err
+}
+
+func setPatronStatus(tx *sql.Tx, ref string, status string) error {
+	_, err := tx.Exec(`INSERT INTO patrons (ref, status) VALUES (?, ?) ON CONFLICT (ref) DO UPDATE SET status = excluded.status`,
+		ref, status)
+	return err
+}
@@ -0,0 +1,301 @@
+// Package events defines the chaincode events emitted by the library
+// chaincodes.
+//
+// Every transaction that changes the catalogue, the circulation of a book or
+// the registration of a patron emits one event. The event name is the name
+// of its Go type, such as "BookBorrowed", and the payload is the type
+// marshalled to JSON. Payloads carry the schema version in their "version"
+// field; fields may be added within a version, but a field is only removed
+// or changes meaning together with a new version.
+//
+// Events are readable by every member of the channel, so they never name a
+// borrower or patron; those stay in the private data collection. Patron
+// events refer to the patron by an opaque reference, and no event links a
+// loan or hold to it.
+//
+// Client code listening for chaincode events decodes them with Decode:
+//
+//	event, err := events.Decode(chaincodeEvent.EventName, chaincodeEvent.Payload)
+//	if borrowed, ok := event.(*events.BookBorrowed); ok {
+//		...
+//	}
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SchemaVersion is the version of the payloads emitted by this package.
+const SchemaVersion = 1
+
+// Event is the payload of a chaincode event.
+type Event interface {
+	// EventName returns the stable name the event is emitted under.
+	EventName() string
+	header() *Header
+}
+
+// Header is embedded in every event.
+type Header struct {
+	// Version is the schema version of the payload.
+	Version int `json:"version"`
+}
+
+func (h *Header) header() *Header {
+	return h
+}
+
+// BookCreated is emitted when a book is added, either with its title details
+// or as a new copy of an existing title.
+type BookCreated struct {
+	Header
+	BookID    string `json:"bookID"`
+	TitleID   string `json:"titleID"`
+	Name      string `json:"name"`
+	Author    string `json:"author"`
+	ISBN      string `json:"isbn"`
+	Publisher string `json:"publisher"`
+}
+
+// BookUpdated is emitted when the catalogue details of a book change. The
+// payload holds the details after the change.
+type BookUpdated struct {
+	Header
+	BookID string `json:"bookID"`
+	// TitleID differs from PreviousTitleID when the book moved to another
+	// title.
+	TitleID         string `json:"titleID"`
+	PreviousTitleID string `json:"previousTitleID"`
+	Name            string `json:"name"`
+	Author          string `json:"author"`
+	ISBN            string `json:"isbn"`
+	Publisher       string `json:"publisher"`
+	Available       bool   `json:"available"`
+}
+
+// BookDeleted is emitted when a book is removed from world state.
+type BookDeleted struct {
+	Header
+	BookID  string `json:"bookID"`
+	TitleID string `json:"titleID"`
+}
+
+// BookWithdrawn is emitted when a book is retired from the collection.
+type BookWithdrawn struct {
+	Header
+	BookID        string `json:"bookID"`
+	TitleID       string `json:"titleID"`
+	Reason        string `json:"reason"`
+	WithdrawnTime int64  `json:"withdrawnTime"`
+}
+
+// BookBorrowed is emitted when a book is lent.
+type BookBorrowed struct {
+	Header
+	BookID      string `json:"bookID"`
+	LoanID      string `json:"loanID"`
+	LendingTime int64  `json:"lendingTime"`
+	DueTime     int64  `json:"dueTime"`
+}
+
+// BookReturned is emitted when a borrowed book comes back.
+type BookReturned struct {
+	Header
+	BookID     string `json:"bookID"`
+	LoanID     string `json:"loanID"`
+	ReturnTime int64  `json:"returnTime"`
+	// Fine is the overdue fine charged for the loan, in cents.
+	Fine int64 `json:"fine"`
+	// Held is true when the book is kept for the first patron in its hold
+	// queue instead of going back on the shelf.
+	Held bool `json:"held"`
+}
+
+// BookRenewed is emitted when a loan is extended.
+type BookRenewed struct {
+	Header
+	BookID   string `json:"bookID"`
+	LoanID   string `json:"loanID"`
+	DueTime  int64  `json:"dueTime"`
+	Renewals int    `json:"renewals"`
+}
+
+// BookLost is emitted when a borrowed book is reported lost, which ends the
+// loan.
+type BookLost struct {
+	Header
+	BookID     string `json:"bookID"`
+	LoanID     string `json:"loanID"`
+	ReportTime int64  `json:"reportTime"`
+	// Fine is the overdue fine plus the lost item fee, in cents.
+	Fine int64 `json:"fine"`
+}
+
+// HoldPlaced is emitted when a patron joins the hold queue of a book.
+type HoldPlaced struct {
+	Header
+	BookID     string `json:"bookID"`
+	HoldID     string `json:"holdID"`
+	Sequence   int64  `json:"sequence"`
+	PlacedTime int64  `json:"placedTime"`
+}
+
+// HoldCancelled is emitted when a patron leaves the hold queue of a book.
+// When the book was kept for that patron it passes to the next patron in
+// its hold queue or goes back on the shelf.
+type HoldCancelled struct {
+	Header
+	BookID   string `json:"bookID"`
+	HoldID   string `json:"holdID"`
+	Sequence int64  `json:"sequence"`
+	// Available and Held are the state of the book afterwards.
+	Available bool `json:"available"`
+	Held      bool `json:"held"`
+}
+
+// HoldExpired is emitted when the pickup window of the hold a returned book
+// was kept for lapses. The book then passes to the next patron in its hold
+// queue or goes back on the shelf.
+type HoldExpired struct {
+	Header
+	BookID   string `json:"bookID"`
+	HoldID   string `json:"holdID"`
+	Sequence int64  `json:"sequence"`
+	// Available and Held are the state of the book afterwards.
+	Available bool `json:"available"`
+	Held      bool `json:"held"`
+}
+
+// FinePaid is emitted when a patron pays part or all of their fines.
+type FinePaid struct {
+	Header
+	EntryID string `json:"entryID"`
+	// Amount is in cents.
+	Amount int64 `json:"amount"`
+	Time   int64 `json:"time"`
+}
+
+// FineWaived is emitted when a librarian waives part or all of a patron's
+// fines.
+type FineWaived struct {
+	Header
+	EntryID string `json:"entryID"`
+	// Amount is in cents.
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+	Time   int64  `json:"time"`
+}
+
+// PatronRegistered is emitted when a patron is registered.
+type PatronRegistered struct {
+	Header
+	// PatronRef is an opaque reference to the patron, assigned when they are
+	// registered. It is not the patron ID.
+	PatronRef  string `json:"patronRef"`
+	Category   string `json:"category"`
+	MaxLoans   int    `json:"maxLoans"`
+	CardExpiry int64  `json:"cardExpiry"`
+}
+
+// PatronUpdated is emitted when the details of a patron change. The payload
+// holds the details after the change.
+type PatronUpdated struct {
+	Header
+	PatronRef  string `json:"patronRef"`
+	Category   string `json:"category"`
+	MaxLoans   int    `json:"maxLoans"`
+	CardExpiry int64  `json:"cardExpiry"`
+}
+
+// PatronSuspended is emitted when a patron is stopped from borrowing.
+type PatronSuspended struct {
+	Header
+	PatronRef string `json:"patronRef"`
+}
+
+// PatronReinstated is emitted when the suspension of a patron is lifted.
+type PatronReinstated struct {
+	Header
+	PatronRef string `json:"patronRef"`
+}
+
+// EventName implements Event.
+func (*BookCreated) EventName() string      { return "BookCreated" }
+func (*BookUpdated) EventName() string      { return "BookUpdated" }
+func (*BookDeleted) EventName() string      { return "BookDeleted" }
+func (*BookWithdrawn) EventName() string    { return "BookWithdrawn" }
+func (*BookBorrowed) EventName() string     { return "BookBorrowed" }
+func (*BookReturned) EventName() string     { return "BookReturned" }
+func (*BookRenewed) EventName() string      { return "BookRenewed" }
+func (*BookLost) EventName() string         { return "BookLost" }
+func (*HoldPlaced) EventName() string       { return "HoldPlaced" }
+func (*HoldCancelled) EventName() string    { return "HoldCancelled" }
+func (*HoldExpired) EventName() string      { return "HoldExpired" }
+func (*FinePaid) EventName() string         { return "FinePaid" }
+func (*FineWaived) EventName() string       { return "FineWaived" }
+func (*PatronRegistered) EventName() string { return "PatronRegistered" }
+func (*PatronUpdated) EventName() string    { return "PatronUpdated" }
+func (*PatronSuspended) EventName() string  { return "PatronSuspended" }
+func (*PatronReinstated) EventName() string { return "PatronReinstated" }
+
+// newEvent returns an empty event for each event name.
+var newEvent = map[string]func() Event{
+	"BookCreated":      func() Event { return &BookCreated{} },
+	"BookUpdated":      func() Event { return &BookUpdated{} },
+	"BookDeleted":      func() Event { return &BookDeleted{} },
+	"BookWithdrawn":    func() Event { return &BookWithdrawn{} },
+	"BookBorrowed":     func() Event { return &BookBorrowed{} },
+	"BookReturned":     func() Event { return &BookReturned{} },
+	"BookRenewed":      func() Event { return &BookRenewed{} },
+	"BookLost":         func() Event { return &BookLost{} },
+	"HoldPlaced":       func() Event { return &HoldPlaced{} },
+	"HoldCancelled":    func() Event { return &HoldCancelled{} },
+	"HoldExpired":      func() Event { return &HoldExpired{} },
+	"FinePaid":         func() Event { return &FinePaid{} },
+	"FineWaived":       func() Event { return &FineWaived{} },
+	"PatronRegistered": func() Event { return &PatronRegistered{} },
+	"PatronUpdated":    func() Event { return &PatronUpdated{} },
+	"PatronSuspended":  func() Event { return &PatronSuspended{} },
+	"PatronReinstated": func() Event { return &PatronReinstated{} },
+}
+
+// Stub is the part of shim.ChaincodeStubInterface used by Emit. The package
+// does not import the shim so that clients can use it alongside the protobuf
+// definitions of the Fabric Gateway SDK.
+type Stub interface {
+	SetEvent(name string, payload []byte) error
+}
+
+// Emit sets event as the chaincode event of the transaction running on stub.
+// Fabric keeps only the last event set by a transaction, so each transaction
+// emits once.
+func Emit(stub Stub, event Event) error {
+	event.header().Version = SchemaVersion
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event %s: %v", event.EventName(), err)
+	}
+	if err := stub.SetEvent(event.EventName(), payload); err != nil {
+		return fmt.Errorf("failed to set event %s: %v", event.EventName(), err)
+	}
+	return nil
+}
+
+// Decode returns the event with the given name and JSON payload. Payloads of
+// a newer schema version than SchemaVersion are refused, as their fields may
+// have changed meaning.
+func Decode(name string, payload []byte) (Event, error) {
+	newFn, ok := newEvent[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown event %q", name)
+	}
+	event := newFn()
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event %s: %v", name, err)
+	}
+	if version := event.header().Version; version < 1 || version > SchemaVersion {
+		return nil, fmt.Errorf("unsupported version %d of event %s", version, name)
+	}
+	return event, nil
+}
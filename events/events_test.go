@@ -0,0 +1,34 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/events"
+)
+
+func TestEmitAndDecode(t *testing.T) {
+	stub := shimtest.NewMockStub("events", nil)
+	err := events.Emit(stub, &events.BookBorrowed{BookID: "B1", LoanID: "tx1", LendingTime: 1000, DueTime: 2000})
+	require.NoError(t, err)
+
+	chaincodeEvent := <-stub.ChaincodeEventsChannel
+	require.Equal(t, "BookBorrowed", chaincodeEvent.EventName)
+	require.JSONEq(t, `{"version":1,"bookID":"B1","loanID":"tx1","lendingTime":1000,"dueTime":2000}`, string(chaincodeEvent.Payload))
+
+	event, err := events.Decode(chaincodeEvent.EventName, chaincodeEvent.Payload)
+	require.NoError(t, err)
+	require.Equal(t, &events.BookBorrowed{Header: events.Header{Version: 1}, BookID: "B1", LoanID: "tx1", LendingTime: 1000, DueTime: 2000}, event)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, err := events.Decode("BookStolen", []byte(`{"version":1}`))
+	require.EqualError(t, err, `unknown event "BookStolen"`)
+	_, err = events.Decode("BookReturned", []byte(`{"version":2,"bookID":"B1"}`))
+	require.EqualError(t, err, "unsupported version 2 of event BookReturned")
+	_, err = events.Decode("BookReturned", []byte(`{"bookID":"B1"}`))
+	require.EqualError(t, err, "unsupported version 0 of event BookReturned")
+	_, err = events.Decode("HoldPlaced", []byte(`{"version":1,"sequence":"1"}`))
+	require.EqualError(t, err, "failed to unmarshal event HoldPlaced: json: cannot unmarshal string into Go struct field HoldPlaced.sequence of type int64")
+}
@@ -0,0 +1,133 @@
+// Package isbn validates and normalizes International Standard Book Numbers.
+//
+// The library chaincodes store every ISBN in canonical form: the 13 digits
+// of the ISBN-13, without hyphens or spaces. An ISBN-10 is converted to the
+// ISBN-13 it is equivalent to, so "0-13-419044-0", "978-0-13-419044-0" and
+// "9780134190440" all identify the same title.
+package isbn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Normalize validates an ISBN-10 or ISBN-13 and returns its canonical
+// ISBN-13. Hyphens and spaces are ignored.
+func Normalize(s string) (string, error) {
+	digits := Strip(s)
+	switch len(digits) {
+	case 10:
+		if err := validate10(digits); err != nil {
+			return "", fmt.Errorf("invalid ISBN %q: %v", s, err)
+		}
+		return To13(digits)
+	case 13:
+		if err := validate13(digits); err != nil {
+			return "", fmt.Errorf("invalid ISBN %q: %v", s, err)
+		}
+		return digits, nil
+	default:
+		return "", fmt.Errorf("invalid ISBN %q: must have 10 or 13 digits, got %d", s, len(digits))
+	}
+}
+
+// Strip removes hyphens and spaces from s and upper-cases a trailing x.
+func Strip(s string) string {
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+	return strings.ToUpper(s)
+}
+
+// To13 converts an ISBN-10 to the equivalent ISBN-13.
+func To13(isbn10 string) (string, error) {
+	digits := Strip(isbn10)
+	if err := validate10(digits); err != nil {
+		return "", fmt.Errorf("invalid ISBN %q: %v", isbn10, err)
+	}
+	body := "978" + digits[:9]
+	return body + string(checkDigit13(body)), nil
+}
+
+// To10 converts an ISBN-13 to the equivalent ISBN-10. Only ISBN-13s in the
+// 978 range have one.
+func To10(isbn13 string) (string, error) {
+	digits := Strip(isbn13)
+	if err := validate13(digits); err != nil {
+		return "", fmt.Errorf("invalid ISBN %q: %v", isbn13, err)
+	}
+	if !strings.HasPrefix(digits, "978") {
+		return "", fmt.Errorf("ISBN %q has no ISBN-10 form", isbn13)
+	}
+	body := digits[3:12]
+	return body + string(checkDigit10(body)), nil
+}
+
+func validate10(digits string) error {
+	if len(digits) != 10 {
+		return fmt.Errorf("ISBN-10 must have 10 digits, got %d", len(digits))
+	}
+	if !isDigits(digits[:9]) {
+		return fmt.Errorf("contains a character that is not a digit")
+	}
+	last := digits[9]
+	if !isDigits(string(last)) && last != 'X' {
+		return fmt.Errorf("check digit must be a digit or X")
+	}
+	if want := checkDigit10(digits[:9]); last != want {
+		return fmt.Errorf("check digit is %c, want %c", last, want)
+	}
+	return nil
+}
+
+func validate13(digits string) error {
+	if len(digits) != 13 {
+		return fmt.Errorf("ISBN-13 must have 13 digits, got %d", len(digits))
+	}
+	if !isDigits(digits) {
+		return fmt.Errorf("contains a character that is not a digit")
+	}
+	if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+		return fmt.Errorf("ISBN-13 must start with 978 or 979")
+	}
+	if want := checkDigit13(digits[:12]); digits[12] != want {
+		return fmt.Errorf("check digit is %c, want %c", digits[12], want)
+	}
+	return nil
+}
+
+// checkDigit10 computes the check digit of the first nine digits of an
+// ISBN-10: the weighted sum with weights 10 down to 2 plus the check digit
+// must be divisible by 11, where X stands for 10.
+func checkDigit10(body string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(body[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// checkDigit13 computes the check digit of the first twelve digits of an
+// ISBN-13, whose digits are weighted alternately 1 and 3.
+func checkDigit13(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(body[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package isbn_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/isbn"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, input := range []string{"9780134190440", "978-0-13-419044-0", "978 0 13 419044 0", "0134190440", "0-13-419044-0"} {
+		canonical, err := isbn.Normalize(input)
+		require.NoError(t, err, input)
+		require.Equal(t, "9780134190440", canonical, input)
+	}
+
+	canonical, err := isbn.Normalize("7-111-00003-x")
+	require.NoError(t, err)
+	require.Equal(t, "9787111000037", canonical)
+
+	_, err = isbn.Normalize("111-1111111111")
+	require.EqualError(t, err, `invalid ISBN "111-1111111111": ISBN-13 must start with 978 or 979`)
+	_, err = isbn.Normalize("978-0-13-419044-1")
+	require.EqualError(t, err, `invalid ISBN "978-0-13-419044-1": check digit is 1, want 0`)
+	_, err = isbn.Normalize("0-13-419044-X")
+	require.EqualError(t, err, `invalid ISBN "0-13-419044-X": check digit is X, want 0`)
+	_, err = isbn.Normalize("97801341904A0")
+	require.EqualError(t, err, `invalid ISBN "97801341904A0": contains a character that is not a digit`)
+	_, err = isbn.Normalize("666-")
+	require.EqualError(t, err, `invalid ISBN "666-": must have 10 or 13 digits, got 3`)
+	_, err = isbn.Normalize("")
+	require.Error(t, err)
+}
+
+func TestConvert(t *testing.T) {
+	isbn10, err := isbn.To10("978-7-111-00003-7")
+	require.NoError(t, err)
+	require.Equal(t, "711100003X", isbn10)
+
+	isbn13, err := isbn.To13(isbn10)
+	require.NoError(t, err)
+	require.Equal(t, "9787111000037", isbn13)
+
+	_, err = isbn.To10("9791034304981")
+	require.EqualError(t, err, `ISBN "9791034304981" has no ISBN-10 form`)
+	_, err = isbn.To13("9780134190440")
+	require.EqualError(t, err, `invalid ISBN "9780134190440": ISBN-10 must have 10 digits, got 13`)
+}
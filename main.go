@@ -1,11 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/hyperledger/fabric-chaincode-go/shim"
-	"github.com/yunlong-le/library/chaincode-2"
+	"github.com/yunlong-le/library/chaincode"
 )
 
 type serverConfig struct {
@@ -18,7 +21,14 @@ func main() {
 		CCID:    os.Getenv("CHAINCODE_ID"),
 		Address: os.Getenv("CHAINCODE_SERVER_ADDRESS"),
 	}
-	cc := new(chaincode.SmartContract)
+	contract, err := contractFromEnv()
+	if err != nil {
+		log.Panicf("Error reading library chaincode configuration: %s", err.Error())
+	}
+	cc, err := chaincode.NewChaincode(contract)
+	if err != nil {
+		log.Panicf("Error creating library chaincode: %s", err.Error())
+	}
 	server := &shim.ChaincodeServer{
 		CCID:    config.CCID,
 		Address: config.Address,
@@ -28,6 +38,62 @@ func main() {
 		},
 	}
 	if err := server.Start(); err != nil {
-		log.Panicf("Error starting asset-transfer-basic chaincode: %s", err.Error())
+		log.Panicf("Error starting library chaincode: %s", err.Error())
+	}
+}
+
+// contractFromEnv configures the contract from the environment of the
+// chaincode. Variables that are not set leave the contract's defaults; the
+// durations must be positive, while a count or amount may be 0, such as
+// FINE_DAILY_RATE=0 for a library without overdue fines. Every peer must run
+// the chaincode with the same values, or their endorsements will not match.
+//
+//	LOAN_PERIOD           loan period, such as 336h
+//	MAX_RENEWALS          renewals allowed per loan
+//	PICKUP_WINDOW         how long a returned book is kept for a hold, such as 72h
+//	FINE_DAILY_RATE       overdue fine per started day, in cents
+//	FINE_CAP              largest overdue fine per loan, in cents
+//	FINE_BLOCK_THRESHOLD  balance in cents above which a patron may not borrow
+//	LOST_ITEM_FEE         fee for a lost book, in cents
+func contractFromEnv() (*chaincode.SmartContract, error) {
+	contract := new(chaincode.SmartContract)
+	durations := map[string]*time.Duration{
+		"LOAN_PERIOD":   &contract.LoanPeriod,
+		"PICKUP_WINDOW": &contract.PickupWindow,
+	}
+	for name, field := range durations {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration, got %q", name, value)
+			}
+			*field = d
+		}
 	}
+
+	if value, ok := os.LookupEnv("MAX_RENEWALS"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("MAX_RENEWALS must be a non-negative integer, got %q", value)
+		}
+		contract.MaxRenewals = &n
+	}
+
+	amounts := map[string]**int64{
+		"FINE_DAILY_RATE":      &contract.FineDailyRate,
+		"FINE_CAP":             &contract.FineCap,
+		"FINE_BLOCK_THRESHOLD": &contract.FineBlockThreshold,
+		"LOST_ITEM_FEE":        &contract.LostItemFee,
+	}
+	for name, field := range amounts {
+		if value, ok := os.LookupEnv(name); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative number of cents, got %q", name, value)
+			}
+			*field = &n
+		}
+	}
+
+	return contract, nil
 }
@@ -0,0 +1,663 @@
+// Package memstub provides an in-memory implementation of
+// shim.ChaincodeStubInterface for testing chaincode without a peer.
+//
+// Unlike shimtest.MockStub, a Stub follows the ledger semantics chaincode
+// sees on a peer:
+//
+//   - Writes are buffered until the transaction commits. Reads within a
+//     transaction return the committed state, not the transaction's own
+//     writes, and a rolled back transaction leaves no trace.
+//   - Range and partial composite key queries return keys in byte order.
+//     Range queries never return composite keys.
+//   - Paginated queries return the first key of the next page as the
+//     bookmark, and an empty bookmark after the last page, as on LevelDB.
+//   - Rich queries fail as they do on LevelDB. The queries are recorded so
+//     tests can check them.
+//   - Every committed write or delete is added to the history of its key,
+//     which GetHistoryForKey returns newest first.
+//   - Only the last event set by a transaction is kept.
+//
+// A transaction is started with Begin and ended with Commit or Rollback;
+// Invoke and Transact do both around a call to the chaincode.
+package memstub
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	compositeKeyNamespace = "\x00"
+	// maxUnicodeRune may not appear in composite key attributes, so it ends
+	// the key range of a partial composite key.
+	maxUnicodeRune = string(utf8.MaxRune)
+)
+
+// Stub is an in-memory ledger and the stub of the transaction running on
+// it. A Stub is not safe for concurrent use.
+type Stub struct {
+	// Name is the chaincode namespace reported in query results.
+	Name string
+	// ChannelID is returned by GetChannelID.
+	ChannelID string
+	// Creator is the serialized identity of the client, such as one returned
+	// by Creator.
+	Creator []byte
+	// Now returns the timestamp of each new transaction. It defaults to
+	// time.Now.
+	Now func() time.Time
+
+	state       map[string][]byte
+	private     map[string]map[string][]byte
+	validation  map[string]map[string][]byte
+	history     map[string][]*queryresult.KeyModification
+	txCount     int
+	tx          *transaction
+	lastEvent   *peer.ChaincodeEvent
+	richQueries []string
+}
+
+type transaction struct {
+	id        string
+	timestamp *timestamp.Timestamp
+	args      [][]byte
+	transient map[string][]byte
+	// writes hold the value written to each key by collection, with "" for
+	// the world state. A nil value deletes the key.
+	writes           map[string]map[string][]byte
+	validationWrites map[string]map[string][]byte
+	event            *peer.ChaincodeEvent
+}
+
+// New returns an empty ledger for the chaincode name.
+func New(name string) *Stub {
+	return &Stub{
+		Name:       name,
+		ChannelID:  "mychannel",
+		Now:        time.Now,
+		state:      map[string][]byte{},
+		private:    map[string]map[string][]byte{},
+		validation: map[string]map[string][]byte{},
+		history:    map[string][]*queryresult.KeyModification{},
+	}
+}
+
+// Begin starts a transaction with the given arguments, the first of which
+// is usually the function name. Transaction IDs are tx1, tx2 and so on.
+func (s *Stub) Begin(args ...string) {
+	s.BeginWithTransient(nil, args...)
+}
+
+// BeginWithTransient starts a transaction with transient data.
+func (s *Stub) BeginWithTransient(transient map[string][]byte, args ...string) {
+	if s.tx != nil {
+		panic(fmt.Sprintf("memstub: transaction %s is still in progress", s.tx.id))
+	}
+	s.txCount++
+	now := s.Now()
+	tx := &transaction{
+		id:               fmt.Sprintf("tx%d", s.txCount),
+		timestamp:        &timestamp.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())},
+		transient:        transient,
+		writes:           map[string]map[string][]byte{},
+		validationWrites: map[string]map[string][]byte{},
+	}
+	for _, arg := range args {
+		tx.args = append(tx.args, []byte(arg))
+	}
+	s.tx = tx
+}
+
+// Commit applies the writes and the event of the current transaction.
+func (s *Stub) Commit() {
+	tx := s.currentTx()
+	for collection, writes := range tx.writes {
+		for key, value := range writes {
+			s.apply(collection, key, value)
+		}
+	}
+	for collection, writes := range tx.validationWrites {
+		if s.validation[collection] == nil {
+			s.validation[collection] = map[string][]byte{}
+		}
+		for key, ep := range writes {
+			s.validation[collection][key] = ep
+		}
+	}
+	s.lastEvent = tx.event
+	s.tx = nil
+}
+
+func (s *Stub) apply(collection string, key string, value []byte) {
+	data := s.state
+	if collection != "" {
+		if s.private[collection] == nil {
+			s.private[collection] = map[string][]byte{}
+		}
+		data = s.private[collection]
+	}
+	if value == nil {
+		delete(data, key)
+	} else {
+		data[key] = value
+	}
+
+	// The history database only covers the world state.
+	if collection == "" {
+		modification := &queryresult.KeyModification{
+			TxId:      s.tx.id,
+			Value:     value,
+			Timestamp: s.tx.timestamp,
+			IsDelete:  value == nil,
+		}
+		s.history[key] = append([]*queryresult.KeyModification{modification}, s.history[key]...)
+	}
+}
+
+// Rollback discards the writes and the event of the current transaction.
+func (s *Stub) Rollback() {
+	s.currentTx()
+	s.lastEvent = nil
+	s.tx = nil
+}
+
+// Invoke runs cc.Invoke in a new transaction, which commits if the
+// chaincode succeeds and rolls back otherwise.
+func (s *Stub) Invoke(cc shim.Chaincode, transient map[string][]byte, args ...string) peer.Response {
+	return s.run(cc.Invoke, transient, args)
+}
+
+// Init runs cc.Init in a new transaction, as Invoke does.
+func (s *Stub) Init(cc shim.Chaincode, args ...string) peer.Response {
+	return s.run(cc.Init, nil, args)
+}
+
+func (s *Stub) run(call func(shim.ChaincodeStubInterface) peer.Response, transient map[string][]byte, args []string) peer.Response {
+	s.BeginWithTransient(transient, args...)
+	response := call(s)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		s.Rollback()
+	} else {
+		s.Commit()
+	}
+	return response
+}
+
+// Transact calls fn in a new transaction, which commits if fn succeeds and
+// rolls back otherwise. It is meant for calling contract functions directly.
+func (s *Stub) Transact(fn func() error, args ...string) error {
+	s.Begin(args...)
+	if err := fn(); err != nil {
+		s.Rollback()
+		return err
+	}
+	s.Commit()
+	return nil
+}
+
+// LastEvent returns the event set by the last transaction, or nil if it set
+// none or was rolled back.
+func (s *Stub) LastEvent() *peer.ChaincodeEvent {
+	return s.lastEvent
+}
+
+// RichQueries returns the rich queries run so far, oldest first.
+func (s *Stub) RichQueries() []string {
+	return s.richQueries
+}
+
+// State returns the committed value of a key in the world state.
+func (s *Stub) State(key string) []byte {
+	return s.state[key]
+}
+
+// Keys returns the keys of the committed world state in order, composite
+// keys first, so tests can inspect the whole of it.
+func (s *Stub) Keys() []string {
+	keys := make([]string, 0, len(s.state))
+	for key := range s.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Stub) currentTx() *transaction {
+	if s.tx == nil {
+		panic("memstub: no transaction is in progress")
+	}
+	return s.tx
+}
+
+// GetArgs implements shim.ChaincodeStubInterface.
+func (s *Stub) GetArgs() [][]byte {
+	if s.tx == nil {
+		return nil
+	}
+	return s.tx.args
+}
+
+// GetStringArgs implements shim.ChaincodeStubInterface.
+func (s *Stub) GetStringArgs() []string {
+	var args []string
+	for _, arg := range s.GetArgs() {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+// GetFunctionAndParameters implements shim.ChaincodeStubInterface.
+func (s *Stub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+// GetArgsSlice implements shim.ChaincodeStubInterface.
+func (s *Stub) GetArgsSlice() ([]byte, error) {
+	var slice []byte
+	for _, arg := range s.GetArgs() {
+		slice = append(slice, arg...)
+	}
+	return slice, nil
+}
+
+// GetTxID implements shim.ChaincodeStubInterface.
+func (s *Stub) GetTxID() string {
+	if s.tx == nil {
+		return ""
+	}
+	return s.tx.id
+}
+
+// GetChannelID implements shim.ChaincodeStubInterface.
+func (s *Stub) GetChannelID() string {
+	return s.ChannelID
+}
+
+// InvokeChaincode implements shim.ChaincodeStubInterface. Calling other
+// chaincodes is not supported.
+func (s *Stub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) peer.Response {
+	return shim.Error(fmt.Sprintf("memstub: cannot invoke chaincode %s", chaincodeName))
+}
+
+// GetState implements shim.ChaincodeStubInterface.
+func (s *Stub) GetState(key string) ([]byte, error) {
+	return s.state[key], nil
+}
+
+// PutState implements shim.ChaincodeStubInterface. Writing an empty value
+// deletes the key, as on a peer.
+func (s *Stub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	return s.write("", key, value)
+}
+
+// DelState implements shim.ChaincodeStubInterface.
+func (s *Stub) DelState(key string) error {
+	return s.write("", key, nil)
+}
+
+func (s *Stub) write(collection string, key string, value []byte) error {
+	if s.tx == nil {
+		return fmt.Errorf("memstub: cannot write %q outside a transaction", key)
+	}
+	if len(value) == 0 {
+		value = nil
+	} else {
+		value = append([]byte(nil), value...)
+	}
+	if s.tx.writes[collection] == nil {
+		s.tx.writes[collection] = map[string][]byte{}
+	}
+	s.tx.writes[collection][key] = value
+	return nil
+}
+
+// SetStateValidationParameter implements shim.ChaincodeStubInterface.
+func (s *Stub) SetStateValidationParameter(key string, ep []byte) error {
+	return s.SetPrivateDataValidationParameter("", key, ep)
+}
+
+// GetStateValidationParameter implements shim.ChaincodeStubInterface.
+func (s *Stub) GetStateValidationParameter(key string) ([]byte, error) {
+	return s.GetPrivateDataValidationParameter("", key)
+}
+
+// GetStateByRange implements shim.ChaincodeStubInterface. An empty
+// startKey or endKey leaves that end of the range open.
+func (s *Stub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if err := validateSimpleKeys(startKey, endKey); err != nil {
+		return nil, err
+	}
+	return s.iterator(s.state, s.rangeKeys(s.state, startKey, endKey)), nil
+}
+
+// GetStateByRangeWithPagination implements shim.ChaincodeStubInterface.
+func (s *Stub) GetStateByRangeWithPagination(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if err := validateSimpleKeys(startKey, endKey); err != nil {
+		return nil, nil, err
+	}
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	iterator, metadata := s.page(s.rangeKeys(s.state, startKey, endKey), pageSize)
+	return iterator, metadata, nil
+}
+
+// GetStateByPartialCompositeKey implements shim.ChaincodeStubInterface.
+func (s *Stub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	matches, err := s.compositeKeys(s.state, objectType, keys, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.iterator(s.state, matches), nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination implements
+// shim.ChaincodeStubInterface.
+func (s *Stub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	matches, err := s.compositeKeys(s.state, objectType, keys, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	iterator, metadata := s.page(matches, pageSize)
+	return iterator, metadata, nil
+}
+
+// CreateCompositeKey implements shim.ChaincodeStubInterface.
+func (s *Stub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+// SplitCompositeKey implements shim.ChaincodeStubInterface.
+func (s *Stub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) || !strings.HasSuffix(compositeKey, "\x00") || len(compositeKey) < 2 {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	components := strings.Split(compositeKey[1:len(compositeKey)-1], "\x00")
+	return components[0], components[1:], nil
+}
+
+// GetQueryResult implements shim.ChaincodeStubInterface. Rich queries are
+// not supported, as on LevelDB.
+func (s *Stub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	s.richQueries = append(s.richQueries, query)
+	return nil, fmt.Errorf("ExecuteQuery not supported for leveldb")
+}
+
+// GetQueryResultWithPagination implements shim.ChaincodeStubInterface.
+func (s *Stub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	s.richQueries = append(s.richQueries, query)
+	return nil, nil, fmt.Errorf("ExecuteQuery not supported for leveldb")
+}
+
+// GetHistoryForKey implements shim.ChaincodeStubInterface.
+func (s *Stub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{results: s.history[key]}, nil
+}
+
+// GetPrivateData implements shim.ChaincodeStubInterface.
+func (s *Stub) GetPrivateData(collection string, key string) ([]byte, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("collection must not be an empty string")
+	}
+	return s.private[collection][key], nil
+}
+
+// GetPrivateDataHash implements shim.ChaincodeStubInterface.
+func (s *Stub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	value, err := s.GetPrivateData(collection, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+// PutPrivateData implements shim.ChaincodeStubInterface.
+func (s *Stub) PutPrivateData(collection string, key string, value []byte) error {
+	if collection == "" {
+		return fmt.Errorf("collection must not be an empty string")
+	}
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	return s.write(collection, key, value)
+}
+
+// DelPrivateData implements shim.ChaincodeStubInterface.
+func (s *Stub) DelPrivateData(collection string, key string) error {
+	if collection == "" {
+		return fmt.Errorf("collection must not be an empty string")
+	}
+	return s.write(collection, key, nil)
+}
+
+// PurgePrivateData implements shim.ChaincodeStubInterface. There is no
+// private data history, so purging is the same as deleting.
+func (s *Stub) PurgePrivateData(collection string, key string) error {
+	return s.DelPrivateData(collection, key)
+}
+
+// SetPrivateDataValidationParameter implements shim.ChaincodeStubInterface.
+func (s *Stub) SetPrivateDataValidationParameter(collection string, key string, ep []byte) error {
+	tx := s.tx
+	if tx == nil {
+		return fmt.Errorf("memstub: cannot write %q outside a transaction", key)
+	}
+	if tx.validationWrites[collection] == nil {
+		tx.validationWrites[collection] = map[string][]byte{}
+	}
+	tx.validationWrites[collection][key] = ep
+	return nil
+}
+
+// GetPrivateDataValidationParameter implements shim.ChaincodeStubInterface.
+func (s *Stub) GetPrivateDataValidationParameter(collection string, key string) ([]byte, error) {
+	return s.validation[collection][key], nil
+}
+
+// GetPrivateDataByRange implements shim.ChaincodeStubInterface.
+func (s *Stub) GetPrivateDataByRange(collection string, startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("collection must not be an empty string")
+	}
+	if err := validateSimpleKeys(startKey, endKey); err != nil {
+		return nil, err
+	}
+	data := s.private[collection]
+	return s.iterator(data, s.rangeKeys(data, startKey, endKey)), nil
+}
+
+// GetPrivateDataByPartialCompositeKey implements shim.ChaincodeStubInterface.
+func (s *Stub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("collection must not be an empty string")
+	}
+	data := s.private[collection]
+	matches, err := s.compositeKeys(data, objectType, keys, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.iterator(data, matches), nil
+}
+
+// GetPrivateDataQueryResult implements shim.ChaincodeStubInterface.
+func (s *Stub) GetPrivateDataQueryResult(collection string, query string) (shim.StateQueryIteratorInterface, error) {
+	s.richQueries = append(s.richQueries, query)
+	return nil, fmt.Errorf("ExecuteQuery not supported for leveldb")
+}
+
+// GetCreator implements shim.ChaincodeStubInterface.
+func (s *Stub) GetCreator() ([]byte, error) {
+	return s.Creator, nil
+}
+
+// GetTransient implements shim.ChaincodeStubInterface.
+func (s *Stub) GetTransient() (map[string][]byte, error) {
+	if s.tx == nil || s.tx.transient == nil {
+		return map[string][]byte{}, nil
+	}
+	return s.tx.transient, nil
+}
+
+// GetBinding implements shim.ChaincodeStubInterface.
+func (s *Stub) GetBinding() ([]byte, error) {
+	return nil, nil
+}
+
+// GetDecorations implements shim.ChaincodeStubInterface.
+func (s *Stub) GetDecorations() map[string][]byte {
+	return nil
+}
+
+// GetSignedProposal implements shim.ChaincodeStubInterface. Transactions
+// are not signed.
+func (s *Stub) GetSignedProposal() (*peer.SignedProposal, error) {
+	return nil, nil
+}
+
+// GetTxTimestamp implements shim.ChaincodeStubInterface.
+func (s *Stub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	if s.tx == nil {
+		return nil, fmt.Errorf("memstub: no transaction is in progress")
+	}
+	return s.tx.timestamp, nil
+}
+
+// SetEvent implements shim.ChaincodeStubInterface.
+func (s *Stub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty string")
+	}
+	tx := s.tx
+	if tx == nil {
+		return fmt.Errorf("memstub: cannot set event %s outside a transaction", name)
+	}
+	tx.event = &peer.ChaincodeEvent{ChaincodeId: s.Name, TxId: tx.id, EventName: name, Payload: payload}
+	return nil
+}
+
+// rangeKeys returns the simple keys of data from startKey up to but not
+// including endKey, in order.
+func (s *Stub) rangeKeys(data map[string][]byte, startKey string, endKey string) []string {
+	var keys []string
+	for key := range data {
+		if strings.HasPrefix(key, compositeKeyNamespace) || key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compositeKeys returns the keys of data that start with the partial
+// composite key and are not before bookmark, in order.
+func (s *Stub) compositeKeys(data map[string][]byte, objectType string, attributes []string, bookmark string) ([]string, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	if bookmark != "" && !strings.HasPrefix(bookmark, prefix) {
+		return nil, fmt.Errorf("bookmark %q is not in the range of the partial composite key", bookmark)
+	}
+	var keys []string
+	for key := range data {
+		if strings.HasPrefix(key, prefix) && key < prefix+maxUnicodeRune && key >= bookmark {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *Stub) iterator(data map[string][]byte, keys []string) *kvIterator {
+	iterator := &kvIterator{}
+	for _, key := range keys {
+		iterator.results = append(iterator.results, &queryresult.KV{Namespace: s.Name, Key: key, Value: data[key]})
+	}
+	return iterator
+}
+
+// page returns the first pageSize keys of the world state, with the key
+// that follows them as the bookmark.
+func (s *Stub) page(keys []string, pageSize int32) (*kvIterator, *peer.QueryResponseMetadata) {
+	metadata := &peer.QueryResponseMetadata{}
+	if pageSize > 0 && len(keys) > int(pageSize) {
+		metadata.Bookmark = keys[pageSize]
+		keys = keys[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(keys))
+	return s.iterator(s.state, keys), metadata
+}
+
+// validateSimpleKeys rejects keys in the composite key namespace.
+func validateSimpleKeys(keys ...string) error {
+	for _, key := range keys {
+		if strings.HasPrefix(key, compositeKeyNamespace) {
+			return fmt.Errorf("first character of the key [%s] contains a null character which is not allowed", key)
+		}
+	}
+	return nil
+}
+
+type kvIterator struct {
+	results []*queryresult.KV
+	closed  bool
+}
+
+func (it *kvIterator) HasNext() bool {
+	return !it.closed && len(it.results) > 0
+}
+
+func (it *kvIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("no more results")
+	}
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+func (it *kvIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
+type historyIterator struct {
+	results []*queryresult.KeyModification
+	closed  bool
+}
+
+func (it *historyIterator) HasNext() bool {
+	return !it.closed && len(it.results) > 0
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("no more results")
+	}
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+func (it *historyIterator) Close() error {
+	it.closed = true
+	return nil
+}
@@ -0,0 +1,193 @@
+package memstub_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/stretchr/testify/require"
+	"github.com/yunlong-le/library/memstub"
+)
+
+// keys drains a query iterator into the keys it returns.
+func keys(t *testing.T, iterator shim.StateQueryIteratorInterface) []string {
+	defer iterator.Close()
+	var keys []string
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		require.NoError(t, err)
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func put(t *testing.T, stub *memstub.Stub, keys ...string) {
+	require.NoError(t, stub.Transact(func() error {
+		for _, key := range keys {
+			if err := stub.PutState(key, []byte("value of "+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestTransactions(t *testing.T) {
+	stub := memstub.New("library")
+	require.EqualError(t, stub.PutState("a", []byte("1")), `memstub: cannot write "a" outside a transaction`)
+
+	stub.Begin("put", "a")
+	require.Equal(t, "tx1", stub.GetTxID())
+	function, params := stub.GetFunctionAndParameters()
+	require.Equal(t, "put", function)
+	require.Equal(t, []string{"a"}, params)
+	require.NoError(t, stub.PutState("a", []byte("1")))
+	value, err := stub.GetState("a")
+	require.NoError(t, err)
+	require.Nil(t, value, "a transaction does not read its own writes")
+	stub.Commit()
+	require.Equal(t, []byte("1"), stub.State("a"))
+
+	err = stub.Transact(func() error {
+		if err := stub.DelState("a"); err != nil {
+			return err
+		}
+		return fmt.Errorf("rejected")
+	})
+	require.EqualError(t, err, "rejected")
+	require.Equal(t, []byte("1"), stub.State("a"))
+
+	// Writing an empty value deletes the key.
+	require.NoError(t, stub.Transact(func() error { return stub.PutState("a", nil) }))
+	require.Empty(t, stub.Keys())
+}
+
+func TestRangeQueries(t *testing.T) {
+	stub := memstub.New("library")
+	book, err := stub.CreateCompositeKey("book", []string{"B1"})
+	require.NoError(t, err)
+	put(t, stub, "B3", "B1", "A", "B2", book)
+
+	iterator, err := stub.GetStateByRange("B", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"B1", "B2", "B3"}, keys(t, iterator))
+	iterator, err = stub.GetStateByRange("", "B2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"A", "B1"}, keys(t, iterator))
+	_, err = stub.GetStateByRange(book, "")
+	require.Error(t, err)
+
+	iterator, metadata, err := stub.GetStateByRangeWithPagination("", "", 3, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"A", "B1", "B2"}, keys(t, iterator))
+	require.Equal(t, "B3", metadata.Bookmark)
+	require.EqualValues(t, 3, metadata.FetchedRecordsCount)
+	iterator, metadata, err = stub.GetStateByRangeWithPagination("", "", 3, metadata.Bookmark)
+	require.NoError(t, err)
+	require.Equal(t, []string{"B3"}, keys(t, iterator))
+	require.Empty(t, metadata.Bookmark)
+}
+
+func TestCompositeKeys(t *testing.T) {
+	stub := memstub.New("library")
+	var created []string
+	for _, attributes := range [][]string{{"p1", "B2"}, {"p1", "B1"}, {"p2", "B3"}, {"p10", "B4"}} {
+		key, err := stub.CreateCompositeKey("publisher", attributes)
+		require.NoError(t, err)
+		created = append(created, key)
+	}
+	other, err := stub.CreateCompositeKey("author", []string{"p1"})
+	require.NoError(t, err)
+	put(t, stub, append(created, other, "p1")...)
+
+	iterator, err := stub.GetStateByPartialCompositeKey("publisher", []string{"p1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{created[1], created[0]}, keys(t, iterator))
+	objectType, attributes, err := stub.SplitCompositeKey(created[1])
+	require.NoError(t, err)
+	require.Equal(t, "publisher", objectType)
+	require.Equal(t, []string{"p1", "B1"}, attributes)
+
+	iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination("publisher", nil, 2, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{created[1], created[0]}, keys(t, iterator))
+	require.Equal(t, created[3], metadata.Bookmark)
+	iterator, metadata, err = stub.GetStateByPartialCompositeKeyWithPagination("publisher", nil, 2, metadata.Bookmark)
+	require.NoError(t, err)
+	require.Equal(t, []string{created[3], created[2]}, keys(t, iterator))
+	require.Empty(t, metadata.Bookmark)
+	_, _, err = stub.GetStateByPartialCompositeKeyWithPagination("publisher", nil, 2, other)
+	require.Error(t, err)
+}
+
+func TestHistory(t *testing.T) {
+	stub := memstub.New("library")
+	stub.Now = func() time.Time { return time.Unix(1000, 0) }
+	put(t, stub, "B1")
+	require.NoError(t, stub.Transact(func() error { return stub.DelState("B1") }))
+
+	iterator, err := stub.GetHistoryForKey("B1")
+	require.NoError(t, err)
+	defer iterator.Close()
+	deleted, err := iterator.Next()
+	require.NoError(t, err)
+	require.Equal(t, "tx2", deleted.TxId)
+	require.True(t, deleted.IsDelete)
+	created, err := iterator.Next()
+	require.NoError(t, err)
+	require.Equal(t, "tx1", created.TxId)
+	require.Equal(t, []byte("value of B1"), created.Value)
+	require.EqualValues(t, 1000, created.Timestamp.Seconds)
+	require.False(t, iterator.HasNext())
+}
+
+func TestPrivateData(t *testing.T) {
+	stub := memstub.New("library")
+	stub.BeginWithTransient(map[string][]byte{"patron": []byte("alice")})
+	transient, err := stub.GetTransient()
+	require.NoError(t, err)
+	require.NoError(t, stub.PutPrivateData("patrons", "alice", transient["patron"]))
+	stub.Commit()
+
+	value, err := stub.GetPrivateData("patrons", "alice")
+	require.NoError(t, err)
+	require.Equal(t, []byte("alice"), value)
+	hash, err := stub.GetPrivateDataHash("patrons", "alice")
+	require.NoError(t, err)
+	require.Len(t, hash, 32)
+	require.Empty(t, stub.Keys(), "private data stays out of the world state")
+	iterator, err := stub.GetHistoryForKey("alice")
+	require.NoError(t, err)
+	require.False(t, iterator.HasNext())
+}
+
+// chaincode sets an event and fails when asked to.
+type chaincode struct{}
+
+func (chaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	return shim.Success(nil)
+}
+
+func (chaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	function, _ := stub.GetFunctionAndParameters()
+	if err := stub.SetEvent(function, []byte(stub.GetTxID())); err != nil {
+		return shim.Error(err.Error())
+	}
+	if function == "fail" {
+		return shim.Error("failed")
+	}
+	return shim.Success(nil)
+}
+
+func TestEvents(t *testing.T) {
+	stub := memstub.New("library")
+	response := stub.Invoke(chaincode{}, nil, "ok")
+	require.EqualValues(t, shim.OK, response.Status)
+	require.Equal(t, &peer.ChaincodeEvent{ChaincodeId: "library", TxId: "tx1", EventName: "ok", Payload: []byte("tx1")}, stub.LastEvent())
+
+	response = stub.Invoke(chaincode{}, nil, "fail")
+	require.EqualValues(t, shim.ERROR, response.Status)
+	require.Nil(t, stub.LastEvent(), "the event of a failed transaction is discarded")
+}